@@ -1,14 +1,34 @@
 package main
 
 import (
+	"archive/tar"
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"crypto/sha256"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"io/fs"
+	"math/bits"
+	"math/rand"
+	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 	"unicode"
 	"unicode/utf8"
@@ -16,7 +36,127 @@ import (
 	"golang.org/x/text/unicode/norm"
 )
 
-const SLURS_JSON = "flags.json"
+const (
+	SLURS_JSON        = "flags.json"
+	CHECKPOINT_FILE   = ".forensics_checkpoint.json"
+	BUCKET_SIZE       = 20000
+	MAX_SPOOL_HANDLES = 64
+	MAX_SERVER_SCANS  = 2
+	URL_CHECK_WORKERS = 4
+	URL_CHECK_RETRIES = 3
+	URL_CHECK_TIMEOUT = 10 * time.Second
+	WEBHOOK_BATCH     = 50
+	WEBHOOK_WORKERS   = 2
+	NEAR_MISS_LIMIT   = 500
+	ARCHIVE_MANIFEST  = "manifest.json"
+)
+
+const (
+	EXIT_CLEAN   = 0
+	EXIT_ERROR   = 1
+	EXIT_HITS    = 2
+	EXIT_NO_DATA = 3
+)
+
+var (
+	appendMode    = flag.Bool("append", false, "append new hits to existing outputs, deduplicated by profile ID")
+	threads       = flag.Int("threads", runtime.NumCPU(), "number of workers compiling flag patterns")
+	allowMissing  = flag.Bool("allow-missing", false, "exit 0 with a warning instead of status 3 when no data directory is found")
+	failOnHits    = flag.Bool("fail-on-hits", false, "exit with status 2 when flagged accounts exceed -hit-threshold")
+	hitLimit      = flag.Int("hit-threshold", 0, "flagged account count tolerated before -fail-on-hits triggers")
+	scanPath      = flag.String("dir", "", "scan a single bucket directory (or its data.json) instead of walking data/www")
+	categoryTree  = flag.Bool("by-category", false, "also write Hits/by_category/<category>/<term>.txt with an index.txt of term counts per category")
+	noCategory    = flag.Bool("no-categories", false, "write per-slur collections without category subdirectories")
+	flatOutput    = flag.Bool("flat", false, "write only the aggregate inappropriate_accounts.txt")
+	watchEvery    = flag.Duration("watch", 0, "after scanning, poll flags.json at this interval and rescan when it changes")
+	quiet         = flag.Bool("quiet", false, "suppress progress output on stderr")
+	sampleSpec    = flag.String("sample", "", "scan a seeded random subset of buckets: a count (50) or a fraction (0.1)")
+	sampleSeed    = flag.Int64("seed", 1, "random seed for -sample")
+	crlf          = flag.Bool("crlf", false, "write txt outputs with CRLF line endings")
+	author        = flag.String("author", "Simon", "filter author named in the header of every txt output")
+	provenanceOn  = flag.Bool("provenance", false, "add the server, data path, flags.json hash and tool version to the header of every txt output")
+	bom           = flag.Bool("bom", false, "prefix txt outputs with a UTF-8 byte order mark")
+	maxCandLen    = flag.Int("max-candidate-length", 0, "skip transform spellings longer than this many characters; the raw and folded username are always matched (0 = no cap)")
+	maxCands      = flag.Int("max-candidates", 7, "match at most this many spellings per username: raw and folded always, then transforms in order (0 = no cap)")
+	enableTf      = flag.String("enable-transforms", "", "comma-separated normalization transforms to turn on (e.g. emoji)")
+	disableTf     = flag.String("disable-transforms", "", "comma-separated normalization transforms to turn off (e.g. collapsed,undecorated)")
+	scriptMix     = flag.Bool("script-mixing", false, "list accounts mixing Latin with look-alike scripts in one word to suspicious_script_mixing.txt")
+	countsCSV     = flag.Bool("counts-csv", false, "write per-term hit counts to slur_counts.csv, most frequent first")
+	cacheSize     = flag.Int("cache-size", 100000, "usernames whose detection results are kept in an LRU cache (0 disables)")
+	archiveIn     = flag.String("archive", "", "scan a .tar.gz written by the scraper's -export-archive instead of data/www")
+	ndjsonIn      = flag.String("input-ndjson", "", "scan newline-delimited JSON account records from this file (- for stdin) instead of data/www")
+	ndUser        = flag.String("ndjson-username", "username", "username field name in -input-ndjson records")
+	ndID          = flag.String("ndjson-id", "id", "profile ID field name in -input-ndjson records")
+	onlyRecent    = flag.Duration("only-recent", 0, "only report accounts whose last_seen is within this window (e.g. 72h)")
+	skipUndated   = flag.Bool("exclude-undated", false, "with -only-recent, skip entries that have no last_seen timestamp")
+	byRank        = flag.Bool("by-rank", false, "section the aggregate output by rank bucket, most prominent accounts first")
+	minFlags      = flag.Int("min-flags", 1, "only report accounts matching at least N distinct flag terms")
+	nearMiss      = flag.Bool("near-miss", false, "write up to 500 unflagged usernames containing a 4+ letter term that failed only the word-boundary check to near_misses.txt")
+	lowConf       = flag.Bool("low-confidence", false, "write accounts below -min-flags to low_confidence_accounts.txt")
+	serverName    = flag.String("server", "auto", "server the data came from (www, br, friends); auto infers it from the data path")
+	streamHits    = flag.Bool("stream", false, "spool per-slur hits to disk during the walk instead of holding them in memory")
+	hitsFormat    = flag.String("hits-format", "", "also write structured hit records: json (hits.json) or ndjson (hits.ndjson)")
+	maxID         = flag.Int64("max-id", 1<<31-1, "largest plausible profile ID; flagged accounts with an ID <= 0 or above it go to flagged_bad_id.txt (0 = no upper bound)")
+	minRank       = flag.Int("min-rank", 0, "smallest rank number to write out (0 = no limit)")
+	maxRank       = flag.Int("max-rank", 0, "largest rank number to write out, e.g. 1000 for the top 1000 (0 = no limit)")
+	caseSens      = flag.Bool("case-sensitive", false, "match flag terms and regexes case-sensitively, e.g. for exact-handle denylists")
+	compatFold    = flag.Bool("compat-fold", false, "apply compatibility decomposition (NFKD) before folding, mapping fullwidth and styled letters to ASCII")
+	diffRoot      = flag.String("diff", "", "previous data root; write accounts flagged now but not in that snapshot to new_hits.txt")
+	masterList    = flag.Bool("master", false, "with -parallel-servers, also write all_servers_master.txt with one row per profile ID listing every server and flag")
+	parallelSrv   = flag.Bool("parallel-servers", false, "scan every server directory under the data root concurrently and write a merged all_servers_accounts.txt")
+	normalizeOnly = flag.Bool("normalize", false, "read usernames from stdin and print their folded form and candidate set instead of scanning")
+	runReport     = flag.String("run-report", "", "merge this run's stats into the forensics section of a run_report.json shared with the scraper")
+	summaryOut    = flag.Bool("summary", false, "write summary.json with per-term counts and an example username, and print it to stderr")
+	relPaths      = flag.Bool("relative-paths", false, "report output paths relative to the data root instead of absolute")
+	debugPats     = flag.Bool("debug-patterns", false, "include the compiled pattern that fired in -hits-format records")
+	adjacentKeys  = flag.Bool("keyboard-adjacent", false, "also match QWERTY-adjacent letter substitutions in terms of 4+ letters (more false positives)")
+	verifyURLs    = flag.Bool("verify-urls", false, "after scanning, HEAD-request each flagged profile URL and write url_check.txt with live/gone status")
+	verifyRate    = flag.Float64("verify-rate", 5, "maximum -verify-urls requests per second")
+	delimiter     = flag.String("delimiter", " | ", "separator between fields of txt output lines, e.g. a tab for spreadsheets")
+	maxNameLen    = flag.Int("max-name-length", 0, "truncate usernames longer than this in txt output, with an ellipsis (0 = no limit)")
+	resume        = flag.Bool("resume", false, "checkpoint finished bucket directories and skip them when an interrupted scan is rerun with -resume")
+	countOnly     = flag.Bool("count-only", false, "run detection but write no files; print total= and category.<name>= counts to stdout")
+	webhookURL    = flag.String("webhook", "", "POST flagged accounts (new ones only with -diff) as JSON batches to this URL")
+	maxEntries    = flag.Int("max-entries-per-bucket", 1000000, "scan at most this many entries of one bucket file, in key order, and warn about the rest (0 = no cap)")
+	dataName      = flag.String("data-file", "data.json", "name of the per-bucket data file to read")
+	explainName   = flag.String("explain", "", "print a step-by-step match trace for this username and exit")
+	fieldMapSpec  = flag.String("map", "", "read entry fields under other names, e.g. username=name,id=uid,rank=position")
+	latestKey     = flag.String("latest-key", "latest", "entry key holding username/id; empty when they sit at the top level of each entry")
+	fieldSpec     = flag.String("fields", "username", "comma-separated entry fields to scan; suffix a field with :strict for whole-token matching")
+)
+
+var (
+	profileIDRe  = regexp.MustCompile(`([^/]*)/profile/([^/]+)/`)
+	whitespaceRe = regexp.MustCompile(`\s+`)
+	separatorRe  = regexp.MustCompile(`[\W_]+`)
+	decorLeadRe  = regexp.MustCompile(`^(?:x*[\W_]+)+`)
+	decorTrailRe = regexp.MustCompile(`(?:[\W_]+x*)+$`)
+	alnumRunRe   = regexp.MustCompile(`[a-zA-Z0-9]+`)
+)
+
+var SERVERS = map[string]string{
+	"www":     "https://www.kogama.com/",
+	"br":      "https://www.kogama.com.br/",
+	"friends": "https://friends.kogama.com/",
+}
+
+var reportBase string
+
+var SMALL_CAPS = map[rune]rune{
+	'ᴀ': 'a', 'ʙ': 'b', 'ᴄ': 'c', 'ᴅ': 'd', 'ᴇ': 'e', 'ꜰ': 'f', 'ɢ': 'g',
+	'ʜ': 'h', 'ɪ': 'i', 'ᴊ': 'j', 'ᴋ': 'k', 'ʟ': 'l', 'ᴍ': 'm', 'ɴ': 'n',
+	'ᴏ': 'o', 'ᴘ': 'p', 'ʀ': 'r', 'ꜱ': 's', 'ᴛ': 't', 'ᴜ': 'u', 'ᴠ': 'v',
+	'ᴡ': 'w', 'ʏ': 'y', 'ᴢ': 'z',
+}
+
+var KEYBOARD_ADJACENT = map[rune]string{
+	'q': "wa", 'w': "qeas", 'e': "wrsd", 'r': "etdf", 't': "ryfg",
+	'y': "tugh", 'u': "yihj", 'i': "uojk", 'o': "ipkl", 'p': "ol",
+	'a': "qwsz", 's': "awedxz", 'd': "serfcx", 'f': "drtgvc", 'g': "ftyhbv",
+	'h': "gyujnb", 'j': "huikmn", 'k': "jiolm", 'l': "kop",
+	'z': "asx", 'x': "zsdc", 'c': "xdfv", 'v': "cfgb", 'b': "vghn",
+	'n': "bhjm", 'm': "njk",
+}
 
 var LEET_TABLE = map[rune][]string{
 	'a': {"a", "4", "@", "ª"},
@@ -47,27 +187,104 @@ var LEET_TABLE = map[rune][]string{
 	'z': {"z", "2"},
 }
 
+func reportPath(path string) string {
+	if reportBase == "" {
+		return path
+	}
+	if rel, err := filepath.Rel(reportBase, path); err == nil {
+		return rel
+	}
+	return path
+}
+
 func utcNowISO() string {
 	return time.Now().UTC().Format("2006-01-02 15:04:05Z")
 }
 
-func headerBlock(count int) string {
-	return fmt.Sprintf(
-		"\"\nLeaderboard Scan taken @ %s in UTC \nAmount of Flagged Accounts in file: %d\nAuthor of the Filter: Simon\n\"\n\n",
-		utcNowISO(),
-		count,
-	)
+func headerBlock(path string, count int) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "\"\nLeaderboard Scan taken @ %s in UTC \nAmount of Flagged Accounts in file: %d\nAuthor of the Filter: %s\n", utcNowISO(), count, *author)
+	if p, ok := provenanceFor(path); *provenanceOn && ok {
+		fmt.Fprintf(&b, "Server: %s\nData: %s\nFlags sha256: %s\nTool: %s\n", p.Server, p.Data, p.FlagsHash, toolVersion())
+	}
+	b.WriteString("\"\n\n")
+	return b.String()
+}
+
+type Provenance struct {
+	Server    string
+	Data      string
+	FlagsHash string
+}
+
+var (
+	provMu     sync.Mutex
+	provenance = make(map[string]Provenance)
+)
+
+// setProvenance records what the files under hitsRoot were generated from;
+// nested roots (Hits/br inside Hits) take precedence for their own files.
+func setProvenance(hitsRoot string, p Provenance) {
+	provMu.Lock()
+	defer provMu.Unlock()
+	provenance[filepath.Clean(hitsRoot)] = p
+}
+
+func provenanceFor(path string) (Provenance, bool) {
+	provMu.Lock()
+	defer provMu.Unlock()
+	for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+		if p, ok := provenance[dir]; ok {
+			return p, true
+		}
+		if filepath.Dir(dir) == dir {
+			return Provenance{}, false
+		}
+	}
+}
+
+func flagsHash() string {
+	b, err := readFlags(flagsPath())
+	if err != nil {
+		return "unknown"
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(b))
+}
+
+func toolVersion() string {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "Forensics (unknown build)"
+	}
+	version := "Forensics " + bi.Main.Version
+	for _, s := range bi.Settings {
+		if s.Key == "vcs.revision" {
+			version += " " + s.Value
+		}
+	}
+	return version
 }
 
 func asciiFold(s string) string {
 	t := norm.NFD.String(s)
+	if *compatFold {
+		t = norm.NFKD.String(strings.Map(func(r rune) rune {
+			if l, ok := SMALL_CAPS[r]; ok {
+				return l
+			}
+			return r
+		}, s))
+	}
 	var b strings.Builder
 	for _, r := range t {
 		if unicode.Is(unicode.Mn, r) {
 			continue
 		}
 		if r < utf8.RuneSelf {
-			b.WriteRune(unicode.ToLower(r))
+			if !*caseSens {
+				r = unicode.ToLower(r)
+			}
+			b.WriteRune(r)
 		}
 	}
 	return b.String()
@@ -91,226 +308,2747 @@ func findDataWWW() (string, bool) {
 	return "", false
 }
 
-func fetchSlurs() map[string]struct{} {
-	b, err := os.ReadFile(SLURS_JSON)
+func detectServer(path string) (string, bool) {
+	for dir := filepath.Clean(path); ; {
+		if _, ok := SERVERS[strings.ToLower(filepath.Base(dir))]; ok {
+			return strings.ToLower(filepath.Base(dir)), true
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", false
+		}
+		dir = parent
+	}
+}
+
+type Flag struct {
+	Raw      bool
+	Category string
+}
+
+type Pattern struct {
+	Re       *regexp.Regexp
+	Strict   *regexp.Regexp
+	Loose    *regexp.Regexp
+	Category string
+}
+
+type Hit struct {
+	ProfileID  string   `json:"profile_id"`
+	Server     string   `json:"server"`
+	URL        string   `json:"url"`
+	Username   string   `json:"username"`
+	Normalized string   `json:"normalized"`
+	Terms      []string `json:"terms"`
+	Categories []string `json:"categories"`
+	Rank       int      `json:"rank,omitempty"`
+	Pages      []int    `json:"pages,omitempty"`
+	ScannedAt  string   `json:"scanned_at"`
+	Patterns   []string `json:"patterns,omitempty"`
+}
+
+type Field struct {
+	Name   string
+	Strict bool
+}
+
+func parseFields(spec string) []Field {
+	var out []Field
+	for _, f := range strings.Split(spec, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		name, mode, _ := strings.Cut(f, ":")
+		out = append(out, Field{Name: name, Strict: mode == "strict"})
+	}
+	return out
+}
+
+type Match struct {
+	Flag     string
+	Category string
+	Pattern  string
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func fetchSlurs() map[string]Flag {
+	out, err := loadSlurs()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(EXIT_ERROR)
+	}
+	return out
+}
+
+func decodeJSON(b []byte, dst any, name string) error {
+	if trimmed, ok := bytes.CutPrefix(b, []byte("\ufeff")); ok {
+		fmt.Fprintf(os.Stderr, "Stripped BOM from %s\n", reportPath(name))
+		b = trimmed
+	}
+	return json.NewDecoder(bytes.NewReader(b)).Decode(dst)
+}
+
+func flagsPath() string {
+	if _, err := os.Stat(SLURS_JSON); err != nil {
+		if _, err := os.Stat(SLURS_JSON + ".gz"); err == nil {
+			return SLURS_JSON + ".gz"
+		}
+	}
+	return SLURS_JSON
+}
+
+func readFlags(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("flags.json not found")
+	}
+	if !bytes.HasPrefix(b, []byte{0x1f, 0x8b}) {
+		return b, nil
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decompress %s: %v", path, err)
+	}
+	defer zr.Close()
+	out, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decompress %s: %v", path, err)
+	}
+	return out, nil
+}
+
+func loadSlurs() (map[string]Flag, error) {
+	path := flagsPath()
+	b, err := readFlags(path)
 	if err != nil {
-		fmt.Println("flags.json not found")
-		os.Exit(1)
+		return nil, err
 	}
 
 	var raw any
-	if err := json.Unmarshal(b, &raw); err != nil {
-		fmt.Println("Failed to parse flags.json")
-		os.Exit(1)
+	if err := decodeJSON(b, &raw, path); err != nil {
+		return nil, fmt.Errorf("Failed to parse flags.json")
+	}
+
+	out := make(map[string]Flag)
+
+	add := func(term string, f Flag) {
+		if _, ok := out[term]; !ok {
+			out[term] = f
+		}
 	}
 
-	out := make(map[string]struct{})
+	var badRegex error
 
-	var walk func(any)
-	walk = func(v any) {
+	var walk func(any, string)
+	walk = func(v any, category string) {
 		switch t := v.(type) {
 		case map[string]any:
-			for _, x := range t {
-				walk(x)
+			if expr, ok := t["regex"].(string); ok {
+				if _, err := regexp.Compile("(?i)" + expr); err != nil {
+					if badRegex == nil {
+						badRegex = fmt.Errorf("Invalid regex in flags.json: %q (%v)", expr, err)
+					}
+					return
+				}
+				add(expr, Flag{Raw: true, Category: category})
+				return
+			}
+			for _, k := range sortedKeys(t) {
+				walk(t[k], k)
 			}
 		case []any:
 			for _, x := range t {
-				walk(x)
+				walk(x, category)
 			}
 		default:
 			s := asciiFold(fmt.Sprint(t))
-			s = regexp.MustCompile(`[^a-z0-9]+`).ReplaceAllString(s, "")
+			s = regexp.MustCompile(`[^a-zA-Z0-9]+`).ReplaceAllString(s, "")
 			if len(s) >= 2 {
-				out[s] = struct{}{}
+				add(s, Flag{Category: category})
 			}
 		}
 	}
 
-	walk(raw)
-	return out
+	walk(raw, "")
+	if badRegex != nil {
+		return nil, badRegex
+	}
+	return out, nil
+}
+
+func buildSlurPattern(slur string, strict bool) *regexp.Regexp {
+	pattern :=
+		caseFlags() + `(?:^|[^a-zA-Z0-9])` +
+			slurBody(slur, strict) +
+			`(?:$|[^a-zA-Z0-9])`
+
+	return regexp.MustCompile(pattern)
 }
 
-func buildSlurPattern(slur string) *regexp.Regexp {
-	var parts []string
+// buildLoosePattern drops the word boundaries; -near-miss uses it to find
+// terms buried inside longer words.
+func buildLoosePattern(slur string) *regexp.Regexp {
+	return regexp.MustCompile(caseFlags() + slurBody(slur, false))
+}
 
+func slurBody(slur string, strict bool) string {
+	var parts, swaps []string
 	for _, r := range slur {
-		if variants, ok := LEET_TABLE[r]; ok {
-			var escaped []string
-			for _, v := range variants {
-				escaped = append(escaped, regexp.QuoteMeta(v))
-			}
-			escaped = append(escaped, regexp.QuoteMeta(string(r)))
-			parts = append(parts, "(?:"+strings.Join(escaped, "|")+")")
-		} else {
-			parts = append(parts, regexp.QuoteMeta(string(r)))
-		}
+		parts = append(parts, charClass(append(slices.Clone(LEET_TABLE[r]), string(r))))
+		swaps = append(swaps, charClass(strings.Split(KEYBOARD_ADJACENT[unicode.ToLower(r)], "")))
 	}
 
 	sep := `[\W_]*`
+	if strict {
+		sep = ""
+	}
+	body := strings.Join(parts, sep)
+	if !*adjacentKeys || utf8.RuneCountInString(slur) < 4 {
+		return body
+	}
 
-	pattern :=
-		`(?i)(?:^|[^a-z0-9])` +
-			strings.Join(parts, sep) +
-			`(?:$|[^a-z0-9])`
+	// At most one letter may be swapped for an adjacent key: one
+	// alternative per position keeps "crap" from matching "vtsp".
+	alts := []string{body}
+	for i, swap := range swaps {
+		if swap == "" {
+			continue
+		}
+		swapped := append([]string(nil), parts...)
+		swapped[i] = swap
+		alts = append(alts, strings.Join(swapped, sep))
+	}
+	return "(?:" + strings.Join(alts, "|") + ")"
+}
 
-	return regexp.MustCompile(pattern)
+// charClass matches any one of the literal variants.
+func charClass(variants []string) string {
+	var escaped []string
+	for _, v := range variants {
+		if v != "" {
+			escaped = append(escaped, regexp.QuoteMeta(v))
+		}
+	}
+	switch len(escaped) {
+	case 0:
+		return ""
+	case 1:
+		return escaped[0]
+	}
+	return "(?:" + strings.Join(escaped, "|") + ")"
 }
 
-func compilePatterns(slurs map[string]struct{}) map[string]*regexp.Regexp {
-	out := make(map[string]*regexp.Regexp)
-	for s := range slurs {
-		out[s] = buildSlurPattern(s)
+func caseFlags() string {
+	if *caseSens {
+		return ""
 	}
-	return out
+	return "(?i)"
 }
 
-func usernameCandidates(raw string) []string {
-	n := asciiFold(raw)
-	collapsed := regexp.MustCompile(`[\W_]+`).ReplaceAllString(n, "")
-	spaceless := strings.ReplaceAll(n, " ", "")
+func compileFlag(term string, f Flag, strict bool) *regexp.Regexp {
+	if f.Raw {
+		return regexp.MustCompile(caseFlags() + term)
+	}
+	return buildSlurPattern(term, strict)
+}
 
-	uniq := map[string]struct{}{
-		raw:       {},
-		n:         {},
-		collapsed: {},
-		spaceless: {},
+func compilePatterns(slurs map[string]Flag) map[string]Pattern {
+	workers := *threads
+	if workers < 1 {
+		workers = 1
 	}
+	started := time.Now()
 
-	var out []string
-	for k := range uniq {
-		out = append(out, k)
+	out := make(map[string]Pattern, len(slurs))
+	jobs := make(chan string)
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for s := range jobs {
+				p := Pattern{
+					Re:       compileFlag(s, slurs[s], false),
+					Strict:   compileFlag(s, slurs[s], true),
+					Category: slurs[s].Category,
+				}
+				if *nearMiss && !slurs[s].Raw && utf8.RuneCountInString(s) >= 4 {
+					p.Loose = buildLoosePattern(s)
+				}
+				mu.Lock()
+				out[s] = p
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for s := range slurs {
+		jobs <- s
+	}
+	close(jobs)
+	wg.Wait()
+
+	if !*quiet {
+		fmt.Fprintf(os.Stderr, "compiled %d patterns in %s with %d threads\n", len(out), time.Since(started).Round(time.Microsecond), workers)
 	}
 	return out
 }
 
-func detect(username string, patterns map[string]*regexp.Regexp) []string {
-	found := make(map[string]struct{})
-	for _, cand := range usernameCandidates(username) {
-		for k, p := range patterns {
-			if p.MatchString(cand) {
-				found[k] = struct{}{}
+// collapseRepeats reduces a token made of one unit repeated to that unit.
+// A unit with doubled letters ("faggfagg") also yields its squeezed form,
+// since the patterns match each letter once.
+func collapseRepeats(s string) string {
+	return alnumRunRe.ReplaceAllStringFunc(s, func(tok string) string {
+		for unit := 3; unit <= len(tok)/2; unit++ {
+			if len(tok)%unit == 0 && strings.Repeat(tok[:unit], len(tok)/unit) == tok {
+				if squeezed := squeezeLetters(tok[:unit]); squeezed != tok[:unit] {
+					return tok[:unit] + " " + squeezed
+				}
+				return tok[:unit]
 			}
 		}
-	}
-	var out []string
-	for k := range found {
-		out = append(out, k)
-	}
-	return out
+		return tok
+	})
 }
 
-func sanitizeFilename(s string) string {
-	s = regexp.MustCompile(`[^a-zA-Z0-9_-]`).ReplaceAllString(s, "_")
-	if s == "" {
-		return "group"
+func squeezeLetters(s string) string {
+	var b strings.Builder
+	prev := rune(-1)
+	for _, r := range s {
+		if r != prev {
+			b.WriteRune(r)
+		}
+		prev = r
 	}
-	return s
+	return b.String()
 }
 
-func writeTxt(path string, lines []string) {
-	os.MkdirAll(filepath.Dir(path), 0755)
-	f, _ := os.Create(path)
-	defer f.Close()
+func stripDecoration(s string) string {
+	return decorTrailRe.ReplaceAllString(decorLeadRe.ReplaceAllString(s, ""), "")
+}
 
-	w := bufio.NewWriter(f)
-	w.WriteString(headerBlock(len(lines)))
-	for _, l := range lines {
-		w.WriteString(l + "\n")
-	}
-	w.Flush()
+type Transform struct {
+	Name    string
+	Fn      func(string) string
+	Enabled bool
+	FromRaw bool
 }
 
-func main() {
-	dataWWW, ok := findDataWWW()
-	if !ok {
-		fmt.Println("Could not locate data/www")
-		os.Exit(1)
+// input picks what a candidate transform works on: the raw username when
+// FromRaw is set, the folded form otherwise.
+func (t *Transform) input(raw, folded string) string {
+	if t.FromRaw {
+		return raw
 	}
+	return folded
+}
 
-	hitsRoot := filepath.Join(filepath.Dir(dataWWW), "Hits")
-	slurDir := filepath.Join(hitsRoot, "Inappropriate_words")
-	collectionsDir := filepath.Join(hitsRoot, "inappropriate_accounts_collections")
+// NORMALIZERS run in order on the raw username before folding; CANDIDATES
+// each derive one extra candidate from the folded form. Other files in this
+// package can append to either from an init func. -max-candidates keeps the
+// raw and folded forms first and drops CANDIDATES from the end of the list.
+var NORMALIZERS = []*Transform{
+	{Name: "emoji", Fn: mapEmojiLetters},
+}
 
-	os.MkdirAll(slurDir, 0755)
-	os.MkdirAll(collectionsDir, 0755)
+var CANDIDATES = []*Transform{
+	{Name: "visible", Fn: stripInvisible, Enabled: true, FromRaw: true},
+	{Name: "collapsed", Fn: collapseSeparators, Enabled: true},
+	{Name: "spaceless", Fn: func(s string) string { return whitespaceRe.ReplaceAllString(s, "") }, Enabled: true},
+	{Name: "undecorated", Fn: stripDecoration, Enabled: true},
+	{Name: "unrepeated", Fn: collapseRepeats, Enabled: true},
+}
 
-	slurs := fetchSlurs()
-	patterns := compilePatterns(slurs)
+func configureTransforms(enable, disable string) error {
+	set := func(spec string, on bool) error {
+		for _, name := range strings.Split(spec, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			found := false
+			for _, list := range [][]*Transform{NORMALIZERS, CANDIDATES} {
+				for _, t := range list {
+					if t.Name == name {
+						t.Enabled = on
+						found = true
+					}
+				}
+			}
+			if !found {
+				return fmt.Errorf("unknown transform %q", name)
+			}
+		}
+		return nil
+	}
+	if err := set(enable, true); err != nil {
+		return err
+	}
+	return set(disable, false)
+}
 
-	var allLines []string
-	bySlur := make(map[string][]string)
+// stripInvisible drops zero-width and other format characters plus
+// combining marks but keeps visible punctuation, so word boundaries that
+// are really there still count.
+func stripInvisible(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.In(r, unicode.Cf, unicode.Mn, unicode.Me) {
+			return -1
+		}
+		return r
+	}, s)
+}
 
-	filepath.WalkDir(dataWWW, func(path string, d fs.DirEntry, _ error) error {
-		if d == nil || !d.IsDir() {
-			return nil
+func collapseSeparators(s string) string {
+	return separatorRe.ReplaceAllString(s, "")
+}
+
+func mapEmojiLetters(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r >= 0x1F1E6 && r <= 0x1F1FF:
+			b.WriteRune('a' + (r - 0x1F1E6))
+		case r >= 0x1F130 && r <= 0x1F149:
+			b.WriteRune('a' + (r - 0x1F130))
+		case r >= 0x1F150 && r <= 0x1F169:
+			b.WriteRune('a' + (r - 0x1F150))
+		case r >= 0x1F170 && r <= 0x1F189:
+			b.WriteRune('a' + (r - 0x1F170))
+		default:
+			b.WriteRune(r)
 		}
+	}
+	return b.String()
+}
 
-		dataFile := filepath.Join(path, "data.json")
-		b, err := os.ReadFile(dataFile)
-		if err != nil {
-			return nil
+func foldUsername(raw string) string {
+	pre := raw
+	for _, t := range NORMALIZERS {
+		if t.Enabled {
+			pre = t.Fn(pre)
 		}
+	}
+	return asciiFold(pre)
+}
 
-		var data map[string]any
-		if json.Unmarshal(b, &data) != nil {
-			return nil
+// usernameCandidates returns the raw and folded username, always in full,
+// then one spelling per enabled transform. The -max-candidates and
+// -max-candidate-length caps only drop generated spellings.
+func usernameCandidates(raw string) []string {
+	n := foldUsername(raw)
+
+	out := []string{raw}
+	seen := map[string]struct{}{raw: {}}
+	add := func(c string) {
+		if _, ok := seen[c]; !ok {
+			seen[c] = struct{}{}
+			out = append(out, c)
 		}
+	}
 
-		var batchLines []string
+	add(n)
+	for _, t := range CANDIDATES {
+		if *maxCands > 0 && len(out) >= *maxCands {
+			break
+		}
+		if !t.Enabled {
+			continue
+		}
+		c := t.Fn(t.input(raw, n))
+		if *maxCandLen > 0 && utf8.RuneCountInString(c) > *maxCandLen {
+			continue
+		}
+		add(c)
+	}
+	return out
+}
 
-		for _, v := range data {
-			m, ok := v.(map[string]any)
-			if !ok {
-				continue
-			}
+type detectLRU struct {
+	mu    sync.Mutex
+	size  int
+	ll    *list.List
+	items map[string]*list.Element
+}
 
-			latest, ok := m["latest"].(map[string]any)
-			if !ok {
-				continue
-			}
+type lruEntry struct {
+	key string
+	val []Match
+}
 
-			username, _ := latest["username"].(string)
-			if username == "" {
-				continue
-			}
+var detectCache *detectLRU
 
-			idFloat, ok := latest["id"].(float64)
-			if !ok {
-				continue
-			}
-			profileID := int64(idFloat)
+func newDetectLRU(size int) *detectLRU {
+	if size <= 0 {
+		return nil
+	}
+	return &detectLRU{size: size, ll: list.New(), items: make(map[string]*list.Element)}
+}
 
-			found := detect(username, patterns)
-			if len(found) == 0 {
-				continue
-			}
+func (c *detectLRU) Get(key string) ([]Match, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[key]; ok {
+		c.ll.MoveToFront(e)
+		return e.Value.(*lruEntry).val, true
+	}
+	return nil, false
+}
 
-			url := fmt.Sprintf("https://www.kogama.com/profile/%d/", profileID)
-			line := fmt.Sprintf("%s | %s", url, username)
+func (c *detectLRU) Put(key string, val []Match) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[key]; ok {
+		c.ll.MoveToFront(e)
+		e.Value.(*lruEntry).val = val
+		return
+	}
+	c.items[key] = c.ll.PushFront(&lruEntry{key: key, val: val})
+	if c.ll.Len() > c.size {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*lruEntry).key)
+	}
+}
 
-			batchLines = append(batchLines, line)
-			allLines = append(allLines, line)
+func detect(username string, patterns map[string]Pattern) []Match {
+	candidates := usernameCandidates(username)
+	if detectCache == nil {
+		return matchCandidates(candidates, patterns, false)
+	}
+
+	key := strings.Join(candidates, "\x00")
+	if m, ok := detectCache.Get(key); ok {
+		return m
+	}
+	m := matchCandidates(candidates, patterns, false)
+	detectCache.Put(key, m)
+	return m
+}
 
-			for _, s := range found {
-				bySlur[s] = append(bySlur[s], line)
+func detectField(text string, patterns map[string]Pattern, strict bool) []Match {
+	if !strict {
+		return matchCandidates(usernameCandidates(text), patterns, false)
+	}
+	return matchCandidates([]string{text, asciiFold(text)}, patterns, true)
+}
+
+func matchCandidates(candidates []string, patterns map[string]Pattern, strict bool) []Match {
+	found := make(map[string]string)
+	for _, cand := range candidates {
+		for k, p := range patterns {
+			re := p.Re
+			if strict {
+				re = p.Strict
+			}
+			if _, ok := found[k]; !ok && re.MatchString(cand) {
+				found[k] = re.String()
 			}
 		}
+	}
+	out := make([]Match, 0, len(found))
+	for _, k := range sortedKeys(found) {
+		out = append(out, Match{Flag: k, Category: patterns[k].Category, Pattern: found[k]})
+	}
+	return out
+}
 
-		if len(batchLines) > 0 {
-			out := filepath.Join(slurDir, sanitizeFilename(filepath.Base(path))+"_slurs.txt")
-			writeTxt(out, batchLines)
+func uniqueMatches(ms []Match) []Match {
+	seen := make(map[string]struct{}, len(ms))
+	out := ms[:0]
+	for _, m := range ms {
+		if _, ok := seen[m.Flag]; ok {
+			continue
 		}
+		seen[m.Flag] = struct{}{}
+		out = append(out, m)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Flag < out[j].Flag })
+	return out
+}
 
-		return nil
-	})
-
-	writeTxt(filepath.Join(hitsRoot, "inappropriate_accounts.txt"), allLines)
+type Escalation struct {
+	Line       string
+	Categories []string
+}
 
-	for slur, lines := range bySlur {
-		out := filepath.Join(collectionsDir, "txt", "slur_"+sanitizeFilename(slur)+".txt")
-		writeTxt(out, lines)
+// escalationLines orders accounts by how many distinct categories they hit,
+// most first, and appends the category list to each line.
+func escalationLines(es []Escalation) []string {
+	sort.SliceStable(es, func(i, j int) bool {
+		if len(es[i].Categories) != len(es[j].Categories) {
+			return len(es[i].Categories) > len(es[j].Categories)
+		}
+		return es[i].Line < es[j].Line
+	})
+	out := make([]string, len(es))
+	for i, e := range es {
+		out[i] = joinFields(e.Line, "categories=["+strings.Join(e.Categories, ",")+"]")
 	}
+	return out
+}
+
+// writeCategoryTree writes one directory per category under by_category,
+// so category names cannot collide with the other outputs in Hits, each
+// holding a file per term and an index.txt listing them, most hits first.
+func writeCategoryTree(hitsRoot string, bySlur map[string][]string, patterns map[string]Pattern) {
+	groups := make(map[string][]string)
+	for slur := range bySlur {
+		c := categoryDir(patterns[slur].Category)
+		groups[c] = append(groups[c], slur)
+	}
+
+	for _, c := range sortedKeys(groups) {
+		dir := filepath.Join(hitsRoot, "by_category", c)
+		terms := groups[c]
+		sort.Slice(terms, func(i, j int) bool {
+			if ni, nj := len(bySlur[terms[i]]), len(bySlur[terms[j]]); ni != nj {
+				return ni > nj
+			}
+			return terms[i] < terms[j]
+		})
+
+		var index strings.Builder
+		for _, term := range terms {
+			name := termFilename(term) + ".txt"
+			writeTxt(filepath.Join(dir, name), bySlur[term])
+			index.WriteString(joinFields(name, strconv.Itoa(len(bySlur[term]))) + "\n")
+		}
+		path := filepath.Join(dir, "index.txt")
+		tmp := path + ".tmp"
+		if os.WriteFile(tmp, []byte(index.String()), 0644) != nil {
+			os.Remove(tmp)
+			continue
+		}
+		os.Rename(tmp, path)
+	}
+}
+
+func categoryDir(category string) string {
+	if category == "" {
+		return "uncategorized"
+	}
+	return sanitizeFilename(category)
+}
+
+var CONFUSABLE_SCRIPTS = []*unicode.RangeTable{
+	unicode.Latin,
+	unicode.Cyrillic,
+	unicode.Greek,
+	unicode.Armenian,
+	unicode.Cherokee,
+}
+
+func mixedScript(s string) bool {
+	words := strings.FieldsFunc(s, func(r rune) bool { return !unicode.IsLetter(r) })
+	for _, w := range words {
+		var mask uint
+		for _, r := range w {
+			for i, t := range CONFUSABLE_SCRIPTS {
+				if unicode.Is(t, r) {
+					mask |= 1 << i
+				}
+			}
+		}
+		if bits.OnesCount(mask) > 1 {
+			return true
+		}
+	}
+	return false
+}
+
+func rankBucket(rank int) (int, int) {
+	if rank <= 0 {
+		return 0, 0
+	}
+	start := ((rank-1)/BUCKET_SIZE)*BUCKET_SIZE + 1
+	return start, start + BUCKET_SIZE - 1
+}
+
+func rankOf(v any) int {
+	switch t := v.(type) {
+	case float64:
+		return int(t)
+	case string:
+		n, _ := strconv.Atoi(strings.TrimSpace(t))
+		return n
+	}
+	return 0
+}
+
+func dirRank(dir string) int {
+	start, _, ok := strings.Cut(filepath.Base(dir), "to")
+	if !ok {
+		return 0
+	}
+	n, _ := strconv.Atoi(start)
+	return n
+}
+
+func inRankRange(rank int) bool {
+	if *minRank <= 0 && *maxRank <= 0 {
+		return true
+	}
+	if rank <= 0 {
+		return false
+	}
+	if *minRank > 0 && rank < *minRank {
+		return false
+	}
+	return *maxRank <= 0 || rank <= *maxRank
+}
+
+func groupByRank(lines []string, ranks []int) []string {
+	idx := make([]int, len(lines))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(a, b int) bool {
+		ra, rb := ranks[idx[a]], ranks[idx[b]]
+		if (ra <= 0) != (rb <= 0) {
+			return ra > 0
+		}
+		return ra < rb
+	})
+
+	var out []string
+	section := ""
+	for _, i := range idx {
+		name := "unranked"
+		if start, end := rankBucket(ranks[i]); start > 0 {
+			name = fmt.Sprintf("%dto%d", start, end)
+		}
+		if name != section {
+			section = name
+			out = append(out, "# "+name)
+		}
+		out = append(out, lines[i])
+	}
+	return out
+}
+
+func plausibleID(id string) bool {
+	n, err := strconv.ParseInt(id, 10, 64)
+	return err == nil && n > 0 && (*maxID <= 0 || n <= *maxID)
+}
+
+func profileIDOf(v any) (id string, fallback bool, ok bool) {
+	switch t := v.(type) {
+	case float64:
+		return strconv.FormatInt(int64(t), 10), false, true
+	case string:
+		t = strings.TrimSpace(t)
+		if t == "" {
+			return "", false, false
+		}
+		if _, err := strconv.ParseInt(t, 10, 64); err == nil {
+			return t, false, true
+		}
+		return url.PathEscape(t), true, true
+	}
+	return "", false, false
+}
+
+func joinFields(fields ...string) string {
+	return strings.Join(fields, *delimiter)
+}
+
+func displayName(username string) string {
+	if *maxNameLen <= 0 || utf8.RuneCountInString(username) <= *maxNameLen {
+		return username
+	}
+	return string([]rune(username)[:*maxNameLen]) + "…"
+}
+
+func sanitizeFilename(s string) string {
+	s = regexp.MustCompile(`[^a-zA-Z0-9_-]`).ReplaceAllString(s, "_")
+	if s == "" {
+		return "group"
+	}
+	return s
+}
+
+// termFilename names a term's output files. Raw regexes lose characters to
+// sanitizeFilename, so a short hash of the expression keeps ones such as
+// f[u]ck and f(u)ck apart.
+func termFilename(term string) string {
+	name := sanitizeFilename(term)
+	if name != term {
+		sum := sha256.Sum256([]byte(term))
+		name += fmt.Sprintf("_%x", sum[:4])
+	}
+	return name
+}
+
+func lineID(line string) string {
+	if m := profileIDRe.FindStringSubmatch(line); m != nil {
+		return m[1] + "/" + m[2]
+	}
+	return line
+}
+
+func readTxt(path string) []string {
+	var out []string
+	eachTxtLine(path, func(l string) {
+		out = append(out, l)
+	})
+	return out
+}
+
+// eachTxtLine streams the non-blank lines of a txt output after its header.
+func eachTxtLine(path string, fn func(string)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	first, inHeader := true, false
+	for sc.Scan() {
+		l := strings.TrimSuffix(sc.Text(), "\r")
+		if first {
+			first = false
+			l = strings.TrimPrefix(l, "\ufeff")
+			if l == "\"" {
+				inHeader = true
+				continue
+			}
+		} else if inHeader {
+			inHeader = l != "\""
+			continue
+		}
+		if strings.TrimSpace(l) != "" {
+			fn(l)
+		}
+	}
+	return sc.Err()
+}
+
+func mergeLines(existing, lines []string) []string {
+	seen := make(map[string]struct{}, len(existing)+len(lines))
+	out := make([]string, 0, len(existing)+len(lines))
+	for _, l := range append(existing, lines...) {
+		id := lineID(l)
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+		out = append(out, l)
+	}
+	return out
+}
+
+func countEntries(lines []string) int {
+	n := 0
+	for _, l := range lines {
+		if !strings.HasPrefix(l, "# ") {
+			n++
+		}
+	}
+	return n
+}
+
+func writeTxt(path string, lines []string) {
+	if *appendMode {
+		lines = mergeLines(readTxt(path), lines)
+	}
+
+	writeLines(path, countEntries(lines), func(emit func(string)) {
+		for _, l := range lines {
+			emit(l)
+		}
+	})
+}
+
+func writeLines(path string, count int, body func(emit func(string))) {
+	os.MkdirAll(filepath.Dir(path), 0755)
+
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return
+	}
+
+	eol := "\n"
+	if *crlf {
+		eol = "\r\n"
+	}
+
+	w := bufio.NewWriter(f)
+	if *bom {
+		w.WriteString("\ufeff")
+	}
+	w.WriteString(strings.ReplaceAll(headerBlock(path, count), "\n", eol))
+	body(func(l string) {
+		w.WriteString(l + eol)
+	})
+	if err := w.Flush(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return
+	}
+	f.Sync()
+	f.Close()
+
+	os.Rename(tmp, path)
+}
+
+type Spool struct {
+	dir    string
+	open   map[string]*os.File
+	counts map[string]int
+}
+
+func newSpool(root string) (*Spool, error) {
+	os.MkdirAll(root, 0755)
+	dir, err := os.MkdirTemp(root, ".spool-")
+	if err != nil {
+		return nil, err
+	}
+	return &Spool{dir: dir, open: make(map[string]*os.File), counts: make(map[string]int)}, nil
+}
+
+func (s *Spool) path(term string) string {
+	return filepath.Join(s.dir, termFilename(term)+".txt")
+}
+
+func (s *Spool) closeAll() {
+	for term, f := range s.open {
+		f.Close()
+		delete(s.open, term)
+	}
+}
+
+func (s *Spool) Add(term, line string) {
+	f, ok := s.open[term]
+	if !ok {
+		if len(s.open) >= MAX_SPOOL_HANDLES {
+			s.closeAll()
+		}
+		var err error
+		f, err = os.OpenFile(s.path(term), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return
+		}
+		s.open[term] = f
+	}
+	if _, err := f.WriteString(line + "\n"); err == nil {
+		s.counts[term]++
+	}
+}
+
+func (s *Spool) Flush(dest func(term string) string) {
+	s.closeAll()
+	defer os.RemoveAll(s.dir)
+
+	for _, term := range sortedKeys(s.counts) {
+		if *appendMode {
+			writeTxt(dest(term), readTxt(s.path(term)))
+			continue
+		}
+
+		f, err := os.Open(s.path(term))
+		if err != nil {
+			continue
+		}
+		writeLines(dest(term), s.counts[term], func(emit func(string)) {
+			sc := bufio.NewScanner(f)
+			sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+			for sc.Scan() {
+				emit(sc.Text())
+			}
+		})
+		f.Close()
+	}
+}
+
+func flagsStamp() string {
+	return fileStamp(flagsPath())
+}
+
+func fileStamp(path string) string {
+	info, err := os.Stat(path)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%d:%d", info.ModTime().UnixNano(), info.Size())
+}
+
+func watchFlags(rescan func(map[string]Pattern)) {
+	stamp := flagsStamp()
+	for range time.Tick(*watchEvery) {
+		if patterns, ok := reloadFlags(&stamp); ok {
+			rescan(patterns)
+		}
+	}
+}
+
+// reloadFlags recompiles flags.json when it changed since *stamp. The new
+// pattern map is only handed out once fully compiled, so a rescan never
+// sees a mix of old and new patterns.
+func reloadFlags(stamp *string) (map[string]Pattern, bool) {
+	next := flagsStamp()
+	if next == *stamp {
+		return nil, false
+	}
+	*stamp = next
+
+	slurs, err := loadSlurs()
+	if err != nil {
+		fmt.Println(err, "- keeping previous filter")
+		return nil, false
+	}
+	fmt.Println("flags.json changed, recompiling and rescanning")
+	return compilePatterns(slurs), true
+}
+
+type ArchiveManifest struct {
+	Server    string `json:"server"`
+	CreatedAt string `json:"created_at"`
+	DataFile  string `json:"data_file"`
+	Buckets   int    `json:"buckets"`
+	Profiles  int    `json:"profiles"`
+}
+
+var errStopWalk = errors.New("stop walking archive")
+
+// walkArchive calls fn with the name and contents of every regular file in
+// a gzipped tar, in archive order.
+func walkArchive(path string, fn func(name string, b []byte) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		if err := fn(hdr.Name, b); err != nil {
+			if err == errStopWalk {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+func readManifest(path string) (ArchiveManifest, error) {
+	var m ArchiveManifest
+	found := false
+	err := walkArchive(path, func(name string, b []byte) error {
+		if name != ARCHIVE_MANIFEST {
+			return nil
+		}
+		found = true
+		if err := decodeJSON(b, &m, name); err != nil {
+			return err
+		}
+		return errStopWalk
+	})
+	if err == nil && !found {
+		err = fmt.Errorf("no %s in archive", ARCHIVE_MANIFEST)
+	}
+	return m, err
+}
+
+// Checkpoint is an append-only log: a header line with the key, then one
+// line per finished bucket directory, so saving costs one line per
+// directory instead of rewriting everything done so far.
+type Checkpoint struct {
+	Key  string               `json:"key"`
+	Dirs map[string]DirResult `json:"-"`
+	path string
+}
+
+// DirResult is what replaying a finished directory needs: its flagged
+// entries, plus the totals of the entries that were not kept.
+type DirResult struct {
+	Dir     string         `json:"dir"`
+	Stamp   string         `json:"stamp"`
+	Entries map[string]any `json:"entries"`
+	Pages   map[string]int `json:"pages"`
+	Scanned int            `json:"scanned"`
+	Undated int            `json:"undated"`
+}
+
+func checkpointKey() string {
+	return flagsStamp() + "|" + strings.Join(os.Args[1:], " ")
+}
+
+func loadCheckpoint(path string) *Checkpoint {
+	c := &Checkpoint{Key: checkpointKey(), Dirs: make(map[string]DirResult), path: path}
+	stale := false
+	first := true
+	err := eachJSONLine(path, func(b []byte) {
+		if first {
+			first = false
+			var head Checkpoint
+			stale = json.Unmarshal(b, &head) != nil || head.Key != c.Key
+			return
+		}
+		var d DirResult
+		if !stale && json.Unmarshal(b, &d) == nil && d.Dir != "" {
+			c.Dirs[d.Dir] = d
+		}
+	})
+
+	switch {
+	case err != nil && !errors.Is(err, fs.ErrNotExist):
+		fmt.Println("Could not read the checkpoint:", err)
+		os.Exit(EXIT_ERROR)
+	case stale:
+		fmt.Println("Checkpoint is stale (flags.json or options changed); starting over.")
+		c.Dirs = make(map[string]DirResult)
+	case len(c.Dirs) > 0:
+		fmt.Printf("Resuming: %d bucket directories already done.\n", len(c.Dirs))
+	}
+
+	if len(c.Dirs) == 0 {
+		b, _ := json.Marshal(c)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		os.WriteFile(path, append(b, '\n'), 0644)
+	}
+	return c
+}
+
+// add records a finished directory; a line torn by a crash is skipped on
+// the next load.
+func (c *Checkpoint) add(d DirResult) {
+	c.Dirs[d.Dir] = d
+	b, err := json.Marshal(d)
+	if err != nil {
+		return
+	}
+	f, err := os.OpenFile(c.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return
+	}
+	f.Write(append(b, '\n'))
+	f.Close()
+}
+
+func eachJSONLine(path string, fn func([]byte)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 256*1024*1024)
+	for sc.Scan() {
+		if b := bytes.TrimSpace(sc.Bytes()); len(b) > 0 {
+			fn(b)
+		}
+	}
+	return sc.Err()
+}
+
+func listBuckets(root string) []string {
+	var out []string
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, _ error) error {
+		if d != nil && d.IsDir() {
+			file := filepath.Join(path, *dataName)
+			if _, err := os.Stat(file); err == nil {
+				out = append(out, file)
+			}
+		}
+		return nil
+	})
+	return out
+}
+
+func sampleBuckets(files []string, spec string, seed int64) ([]string, error) {
+	k := 0
+	if strings.Contains(spec, ".") {
+		frac, err := strconv.ParseFloat(spec, 64)
+		if err != nil || frac <= 0 || frac > 1 {
+			return nil, fmt.Errorf("invalid -sample fraction %q", spec)
+		}
+		k = int(frac*float64(len(files)) + 0.5)
+	} else {
+		n, err := strconv.Atoi(spec)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid -sample count %q", spec)
+		}
+		k = n
+	}
+	if k > len(files) {
+		k = len(files)
+	}
+
+	rng := rand.New(rand.NewSource(seed))
+	out := make([]string, 0, k)
+	for _, i := range rng.Perm(len(files))[:k] {
+		out = append(out, files[i])
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+type Progress struct {
+	total int
+	done  int
+	last  time.Time
+}
+
+func (p *Progress) Step() {
+	p.done++
+	if *quiet || (time.Since(p.last) < time.Second && p.done < p.total) {
+		return
+	}
+	p.last = time.Now()
+	pct := 100.0
+	if p.total > 0 {
+		pct = float64(p.done) * 100 / float64(p.total)
+	}
+	fmt.Fprintf(os.Stderr, "scanned %d/%d dirs (%.1f%%)\n", p.done, p.total, pct)
+}
+
+func matchEntry(latest map[string]any, username string, patterns map[string]Pattern, fields []Field) []Match {
+	var found []Match
+	for _, f := range fields {
+		if f.Name == "username" && !f.Strict {
+			found = append(found, detect(username, patterns)...)
+			continue
+		}
+		if text, ok := latest[f.Name].(string); ok && text != "" {
+			found = append(found, detectField(text, patterns, f.Strict)...)
+		}
+	}
+	return uniqueMatches(found)
+}
+
+func latestOf(entry map[string]any) (map[string]any, bool) {
+	if entry == nil {
+		return nil, false
+	}
+	if *latestKey == "" {
+		return applyFieldMap(entry), true
+	}
+	latest, ok := entry[*latestKey].(map[string]any)
+	return applyFieldMap(latest), ok
+}
+
+// fieldMap maps the names this tool reads (username, id, rank, ...) to the
+// names a foreign data source uses; it is filled from -map.
+var fieldMap map[string]string
+
+func parseFieldMap(spec string) (map[string]string, error) {
+	out := make(map[string]string)
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, source, ok := strings.Cut(pair, "=")
+		name, source = strings.TrimSpace(name), strings.TrimSpace(source)
+		if !ok || name == "" || source == "" {
+			return nil, fmt.Errorf("invalid -map entry %q, want name=source", pair)
+		}
+		out[name] = source
+	}
+	return out, nil
+}
+
+// applyFieldMap returns a copy of entry with each mapped field copied to
+// its usual name. Sources missing from the entry leave the field as it was.
+func applyFieldMap(entry map[string]any) map[string]any {
+	if len(fieldMap) == 0 || entry == nil {
+		return entry
+	}
+	out := make(map[string]any, len(entry)+len(fieldMap))
+	for k, v := range entry {
+		out[k] = v
+	}
+	for name, source := range fieldMap {
+		if v, ok := entry[source]; ok {
+			out[name] = v
+		}
+	}
+	return out
+}
+
+func flaggedIDs(root string, patterns map[string]Pattern, fields []Field) map[string]struct{} {
+	ids := make(map[string]struct{})
+	for _, file := range listBuckets(root) {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		var data map[string]any
+		if decodeJSON(b, &data, file) != nil {
+			continue
+		}
+		for _, v := range data {
+			m, _ := v.(map[string]any)
+			latest, ok := latestOf(m)
+			if !ok {
+				continue
+			}
+			username, _ := latest["username"].(string)
+			profileID, _, ok := profileIDOf(latest["id"])
+			if username == "" || !ok {
+				continue
+			}
+			if len(matchEntry(latest, username, patterns, fields)) >= *minFlags {
+				ids[profileID] = struct{}{}
+			}
+		}
+	}
+	return ids
+}
+
+// scan returns the number of flagged accounts, their aggregate lines and,
+// when some output needs them, their Hit records. Under -stream the lines
+// are spooled to disk instead and the returned slice is nil.
+func scan(server, dataWWW, single, hitsRoot string, patterns map[string]Pattern, fields []Field) (int, []string, []Hit) {
+	slurDir := filepath.Join(hitsRoot, "Inappropriate_words")
+	collectionsDir := filepath.Join(hitsRoot, "inappropriate_accounts_collections")
+
+	if !*flatOutput && !*countOnly {
+		os.MkdirAll(slurDir, 0755)
+		os.MkdirAll(collectionsDir, 0755)
+	}
+
+	if *provenanceOn {
+		source := dataWWW
+		switch {
+		case *ndjsonIn == "-":
+			source = "stdin"
+		case *ndjsonIn != "":
+			source = *ndjsonIn
+		case *archiveIn != "":
+			source = *archiveIn
+		case single != "":
+			source = single
+		}
+		setProvenance(hitsRoot, Provenance{Server: server, Data: reportPath(source), FlagsHash: flagsHash()})
+	}
+
+	var previous map[string]struct{}
+	var newLines []string
+	if *diffRoot != "" {
+		previous = flaggedIDs(*diffRoot, patterns, fields)
+	}
+
+	var allLines []string
+	var allRanks []int
+	bySlur := make(map[string][]string)
+	slurCounts := make(map[string]int)
+	examples := make(map[string]string)
+	byCategory := make(map[string]int)
+	scanned := 0
+	pagesFlagged := make(map[string]int)
+	pagesAll := make(map[string]int)
+	flagged := 0
+	var spool, aggSpool *Spool
+	if *streamHits && !*countOnly {
+		var err error
+		if aggSpool, err = newSpool(hitsRoot); err == nil {
+			spool, err = newSpool(hitsRoot)
+		}
+		if err != nil {
+			fmt.Println("Could not create spool directory:", err)
+			os.Exit(EXIT_ERROR)
+		}
+	}
+	seen := make(map[string]struct{})
+	suspicious := make(map[string]string)
+	lowConfidence := make(map[string]string)
+	var nearMisses, looseTerms []string
+	for _, term := range sortedKeys(patterns) {
+		if patterns[term].Loose != nil {
+			looseTerms = append(looseTerms, term)
+		}
+	}
+	outOfRange := make(map[string]struct{})
+	fallbacks := 0
+
+	var files []string
+	switch {
+	case *ndjsonIn != "", *archiveIn != "":
+	case single != "":
+		files = []string{single}
+	default:
+		files = listBuckets(dataWWW)
+	}
+	available := len(files)
+	if *sampleSpec != "" {
+		sampled, err := sampleBuckets(files, *sampleSpec, *sampleSeed)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(EXIT_ERROR)
+		}
+		files = sampled
+	}
+
+	progress := &Progress{total: len(files)}
+
+	undated := 0
+	cutoff := time.Now().Add(-*onlyRecent)
+	keepRecent := func(v any) bool {
+		if *onlyRecent <= 0 {
+			return true
+		}
+		ts, _ := v.(string)
+		t, err := time.Parse(time.RFC3339, ts)
+		if err != nil {
+			undated++
+			return !*skipUndated
+		}
+		return !t.Before(cutoff)
+	}
+
+	scannedAt := time.Now().UTC().Format(time.RFC3339)
+	var hits, hooked []Hit
+
+	var noID, badID []string
+	var escalate []Escalation
+	touched := false
+
+	scanEntry := func(latest map[string]any, pages any, fallbackRank int, source string) (string, bool) {
+		username, _ := latest["username"].(string)
+		if username == "" {
+			return "", false
+		}
+		scanned++
+
+		profileID, fallback, ok := profileIDOf(latest["id"])
+		if !ok {
+			if len(matchEntry(latest, username, patterns, fields)) >= *minFlags {
+				noID = append(noID, joinFields(source, displayName(username), fmt.Sprintf("id=%v", latest["id"])))
+				touched = true
+			}
+			return "", false
+		}
+		if !fallback && !plausibleID(profileID) {
+			if len(matchEntry(latest, username, patterns, fields)) >= *minFlags {
+				badID = append(badID, joinFields(source, displayName(username), "id="+profileID))
+				touched = true
+			}
+			return "", false
+		}
+
+		profileURL := fmt.Sprintf("%sprofile/%s/", SERVERS[server], profileID)
+		line := joinFields(profileURL, displayName(username))
+
+		if *scriptMix && mixedScript(username) {
+			touched = true
+			if _, dup := suspicious[profileID]; !dup {
+				suspicious[profileID] = line
+			}
+		}
+
+		found := matchEntry(latest, username, patterns, fields)
+		if len(found) == 0 {
+			if *nearMiss && len(nearMisses) < NEAR_MISS_LIMIT {
+				if term, ok := boundaryMiss(username, looseTerms, patterns); ok {
+					nearMisses = append(nearMisses, joinFields(line, "term="+term))
+					touched = true
+				}
+			}
+			return "", false
+		}
+		touched = true
+		if len(found) < *minFlags {
+			if *lowConf {
+				if _, dup := lowConfidence[profileID]; !dup {
+					lowConfidence[profileID] = line
+				}
+			}
+			return "", false
+		}
+
+		rank := rankOf(latest["rank"])
+		if !inRankRange(rank) {
+			outOfRange[profileID] = struct{}{}
+			return "", false
+		}
+		if rank <= 0 {
+			rank = fallbackRank
+		}
+
+		if fallback {
+			fallbacks++
+		}
+
+		if _, dup := seen[profileID]; dup {
+			return line, true
+		}
+		seen[profileID] = struct{}{}
+		flagged++
+		switch {
+		case aggSpool != nil:
+			aggSpool.Add("all", line)
+		case !*countOnly:
+			allLines = append(allLines, line)
+		}
+		if n := pageCount(pages); n > 0 {
+			pagesFlagged[pagesBucket(n)]++
+		}
+
+		cats := make(map[string]struct{})
+		for _, m := range found {
+			cats[categoryDir(m.Category)] = struct{}{}
+		}
+		for c := range cats {
+			byCategory[c]++
+		}
+		if len(cats) >= 2 {
+			escalate = append(escalate, Escalation{Line: line, Categories: sortedKeys(cats)})
+		}
+		fresh := true
+		if previous != nil {
+			if _, ok := previous[profileID]; ok {
+				fresh = false
+			} else {
+				newLines = append(newLines, line)
+			}
+		}
+		if *byRank {
+			allRanks = append(allRanks, rank)
+		}
+
+		if *hitsFormat != "" || *webhookURL != "" || *masterList {
+			h := newHit(server, profileID, profileURL, username, rank, pages, found, scannedAt)
+			hits = append(hits, h)
+			if fresh {
+				hooked = append(hooked, h)
+			}
+		}
+
+		for _, s := range found {
+			slurCounts[s.Flag]++
+			if _, ok := examples[s.Flag]; !ok {
+				examples[s.Flag] = username
+			}
+			switch {
+			case spool != nil:
+				spool.Add(s.Flag, line)
+			case !*streamHits:
+				bySlur[s.Flag] = append(bySlur[s.Flag], line)
+			}
+		}
+		return line, true
+	}
+
+	writeBatch := func(name string, batchLines []string) {
+		if len(batchLines) > 0 && !*flatOutput && !*countOnly {
+			out := filepath.Join(slurDir, sanitizeFilename(name)+"_slurs.txt")
+			writeTxt(out, batchLines)
+		}
+	}
+
+	var ckpt *Checkpoint
+	ckptPath := filepath.Join(hitsRoot, CHECKPOINT_FILE)
+	if *resume {
+		ckpt = loadCheckpoint(ckptPath)
+	}
+
+	scanBucket := func(dataFile string, data map[string]any, replay bool) (map[string]any, map[string]int) {
+		if *maxEntries > 0 && len(data) > *maxEntries {
+			fmt.Fprintf(os.Stderr, "Warning: %s has %d entries; scanning only the first %d by key (-max-entries-per-bucket).\n", reportPath(dataFile), len(data), *maxEntries)
+			capped := make(map[string]any, *maxEntries)
+			for _, k := range sortedKeys(data)[:*maxEntries] {
+				capped[k] = data[k]
+			}
+			data = capped
+		}
+		kept := make(map[string]any)
+		pages := make(map[string]int)
+
+		var batchLines []string
+		bucket := filepath.Base(filepath.Dir(dataFile))
+		for key, v := range data {
+			m, ok := v.(map[string]any)
+			if !ok {
+				continue
+			}
+
+			latest, ok := latestOf(m)
+			if !ok {
+				continue
+			}
+
+			if !keepRecent(m["last_seen"]) {
+				continue
+			}
+
+			if n := pageCount(m["pages"]); n > 0 && !replay {
+				pagesAll[pagesBucket(n)]++
+				pages[pagesBucket(n)]++
+			}
+
+			touched = false
+			if line, ok := scanEntry(latest, m["pages"], dirRank(filepath.Dir(dataFile)), bucket+"/"+key); ok {
+				batchLines = append(batchLines, line)
+			}
+			if touched {
+				kept[key] = m
+			}
+		}
+		writeBatch(bucket, batchLines)
+		return kept, pages
+	}
+
+	scanFile := func(dataFile string) {
+		stamp := fileStamp(dataFile)
+		done, replay := DirResult{}, false
+		if ckpt != nil {
+			done, replay = ckpt.Dirs[dataFile]
+			replay = replay && done.Stamp == stamp
+		}
+
+		var data map[string]any
+		if replay {
+			progress.Step()
+			data = done.Entries
+			for k, n := range done.Pages {
+				pagesAll[k] += n
+			}
+		} else {
+			b, err := os.ReadFile(dataFile)
+			if err != nil {
+				return
+			}
+			progress.Step()
+
+			if decodeJSON(b, &data, dataFile) != nil {
+				return
+			}
+		}
+
+		scannedBefore, undatedBefore := scanned, undated
+		kept, pages := scanBucket(dataFile, data, replay)
+		if replay {
+			// Only the flagged entries were kept; restore the totals the
+			// original pass counted over the whole directory.
+			scanned, undated = scannedBefore+done.Scanned, undatedBefore+done.Undated
+		}
+
+		if ckpt != nil && !replay {
+			ckpt.add(DirResult{
+				Dir:     dataFile,
+				Stamp:   stamp,
+				Entries: kept,
+				Pages:   pages,
+				Scanned: scanned - scannedBefore,
+				Undated: undated - undatedBefore,
+			})
+		}
+	}
+
+	scanArchive := func(path string) {
+		var m ArchiveManifest
+		err := walkArchive(path, func(name string, b []byte) error {
+			if name == ARCHIVE_MANIFEST {
+				if err := decodeJSON(b, &m, name); err != nil {
+					return err
+				}
+				progress.total = m.Buckets
+				return nil
+			}
+			if m.DataFile == "" {
+				m.DataFile = *dataName
+			}
+			if filepath.Base(name) != m.DataFile {
+				return nil
+			}
+			progress.Step()
+
+			var data map[string]any
+			if decodeJSON(b, &data, name) == nil {
+				scanBucket(name, data, false)
+			}
+			return nil
+		})
+		if err != nil {
+			fmt.Println("Could not read", path+":", err)
+			os.Exit(EXIT_ERROR)
+		}
+	}
+
+	scanNDJSON := func(r io.Reader, name string) {
+		sc := bufio.NewScanner(r)
+		sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+		var batchLines []string
+		lineNo, malformed, firstBad := 0, 0, 0
+		for sc.Scan() {
+			lineNo++
+			text := strings.TrimSpace(sc.Text())
+			if text == "" {
+				continue
+			}
+
+			var rec map[string]any
+			if decodeJSON([]byte(text), &rec, name) != nil || rec == nil {
+				if malformed == 0 {
+					firstBad = lineNo
+				}
+				malformed++
+				continue
+			}
+
+			if !keepRecent(rec["last_seen"]) {
+				continue
+			}
+
+			// Rows streamed by the scraper's -stdout-ndjson nest the
+			// profile under -latest-key next to its uid.
+			src := rec
+			if nested, ok := rec[*latestKey].(map[string]any); ok && *latestKey != "" {
+				src = nested
+			}
+			src = applyFieldMap(src)
+			latest := make(map[string]any, len(src)+2)
+			for k, v := range src {
+				latest[k] = v
+			}
+			latest["username"] = src[*ndUser]
+			latest["id"] = src[*ndID]
+			if latest["id"] == nil {
+				latest["id"] = rec["uid"]
+			}
+
+			if line, ok := scanEntry(latest, rec["pages"], 0, fmt.Sprintf("ndjson:%d", lineNo)); ok {
+				batchLines = append(batchLines, line)
+			}
+		}
+		if err := sc.Err(); err != nil {
+			fmt.Println("Error reading NDJSON input:", err)
+		}
+		if malformed > 0 {
+			fmt.Fprintf(os.Stderr, "Warning: skipped %d malformed lines in %s (first at line %d).\n", malformed, reportPath(name), firstBad)
+		}
+		writeBatch("ndjson", batchLines)
+	}
+
+	if *ndjsonIn != "" {
+		in, name := os.Stdin, "stdin"
+		if *ndjsonIn != "-" {
+			f, err := os.Open(*ndjsonIn)
+			if err != nil {
+				fmt.Println("Could not open", *ndjsonIn)
+				os.Exit(EXIT_ERROR)
+			}
+			defer f.Close()
+			in, name = f, *ndjsonIn
+		}
+		scanNDJSON(in, name)
+	} else if *archiveIn != "" {
+		scanArchive(*archiveIn)
+	} else {
+		for _, f := range files {
+			scanFile(f)
+		}
+		if ckpt != nil {
+			os.Remove(ckptPath)
+		}
+	}
+
+	recordRun(server, scanned, flagged, byCategory)
+
+	if undated > 0 {
+		verb := "included"
+		if *skipUndated {
+			verb = "skipped"
+		}
+		fmt.Fprintf(os.Stderr, "Warning: %d entries had no last_seen timestamp and were %s by -only-recent.\n", undated, verb)
+	}
+
+	if *countOnly {
+		fmt.Printf("total=%d\n", flagged)
+		for _, c := range sortedKeys(byCategory) {
+			fmt.Printf("category.%s=%d\n", c, byCategory[c])
+		}
+		return flagged, nil, hits
+	}
+
+	aggregatePath := filepath.Join(hitsRoot, "inappropriate_accounts.txt")
+	switch {
+	case aggSpool != nil:
+		aggSpool.Flush(func(string) string { return aggregatePath })
+		if flagged == 0 {
+			writeTxt(aggregatePath, nil)
+		}
+	case *byRank:
+		writeTxt(aggregatePath, groupByRank(allLines, allRanks))
+	default:
+		writeTxt(aggregatePath, allLines)
+	}
+
+	if previous != nil {
+		writeTxt(filepath.Join(hitsRoot, "new_hits.txt"), newLines)
+	}
+
+	if *hitsFormat != "" {
+		writeHits(filepath.Join(hitsRoot, "hits."+*hitsFormat), hits)
+	}
+
+	if *webhookURL != "" && len(hooked) > 0 {
+		client := &http.Client{Timeout: URL_CHECK_TIMEOUT}
+		sent := postHits(client, *webhookURL, hooked)
+		fmt.Printf("Webhook: delivered %d of %d hits.\n", sent, len(hooked))
+	}
+
+	if *verifyURLs {
+		client := &http.Client{Timeout: URL_CHECK_TIMEOUT}
+		writeTxt(filepath.Join(hitsRoot, "url_check.txt"), checkURLs(client, allLines, *verifyRate))
+	}
+
+	if len(noID) > 0 {
+		sort.Strings(noID)
+		writeTxt(filepath.Join(hitsRoot, "flagged_no_id.txt"), noID)
+	}
+	if len(badID) > 0 {
+		sort.Strings(badID)
+		writeTxt(filepath.Join(hitsRoot, "flagged_bad_id.txt"), badID)
+	}
+	if len(escalate) > 0 {
+		writeTxt(filepath.Join(hitsRoot, "escalate.txt"), escalationLines(escalate))
+	}
+
+	appendTrend(filepath.Join(hitsRoot, "slur_trends.jsonl"), scannedAt, flagged, slurCounts)
+
+	if *summaryOut {
+		writeSummary(filepath.Join(hitsRoot, "summary.json"), RunSummary{
+			ScannedAt:    utcNowISO(),
+			Total:        flagged,
+			NoID:         len(noID),
+			Terms:        termSummaries(slurCounts, examples),
+			PagesFlagged: pagesFlagged,
+			PagesAll:     pagesAll,
+		})
+	}
+
+	if *countsCSV {
+		writeCountsCSV(filepath.Join(hitsRoot, "slur_counts.csv"), slurCounts, patterns, flagged)
+	}
+
+	if *scriptMix {
+		lines := make([]string, 0, len(suspicious))
+		for _, id := range sortedKeys(suspicious) {
+			lines = append(lines, suspicious[id])
+		}
+		writeTxt(filepath.Join(hitsRoot, "suspicious_script_mixing.txt"), lines)
+	}
+
+	if *nearMiss {
+		writeTxt(filepath.Join(hitsRoot, "near_misses.txt"), nearMisses)
+	}
+
+	if *lowConf {
+		lines := make([]string, 0, len(lowConfidence))
+		for _, id := range sortedKeys(lowConfidence) {
+			lines = append(lines, lowConfidence[id])
+		}
+		writeTxt(filepath.Join(hitsRoot, "low_confidence_accounts.txt"), lines)
+	}
+
+	collectionPath := func(slur string) string {
+		dir := filepath.Join(collectionsDir, "txt")
+		if !*noCategory {
+			dir = filepath.Join(dir, categoryDir(patterns[slur].Category))
+		}
+		return filepath.Join(dir, "slur_"+termFilename(slur)+".txt")
+	}
+
+	if spool != nil {
+		spool.Flush(collectionPath)
+	} else if !*flatOutput {
+		for slur, lines := range bySlur {
+			writeTxt(collectionPath(slur), lines)
+		}
+	}
+
+	if *categoryTree {
+		writeCategoryTree(hitsRoot, bySlur, patterns)
+	}
+
+	fmt.Printf("Done. Found %d accounts with slurs.\n", flagged)
+	fmt.Printf("TXT hits written to %s\n", reportPath(hitsRoot))
+	if *sampleSpec != "" {
+		fmt.Printf("Sampled run: scanned %d of %d bucket directories (seed %d).\n", len(files), available, *sampleSeed)
+	}
+	if previous != nil {
+		fmt.Printf("%d accounts are newly flagged since %s.\n", len(newLines), *diffRoot)
+	}
+	if len(noID) > 0 {
+		fmt.Printf("%d flagged accounts had no usable ID; see flagged_no_id.txt.\n", len(noID))
+	}
+	if len(badID) > 0 {
+		fmt.Printf("%d flagged accounts had implausible IDs (<= 0 or above -max-id); see flagged_bad_id.txt.\n", len(badID))
+	}
+	if len(outOfRange) > 0 {
+		fmt.Printf("%d flagged accounts outside the -min-rank/-max-rank range (or without a rank) were omitted.\n", len(outOfRange))
+	}
+	if fallbacks > 0 {
+		fmt.Printf("%d flagged accounts had non-numeric IDs; review their URLs manually.\n", fallbacks)
+	}
+
+	return flagged, allLines, hits
+}
+
+func findDataRoot() (string, bool) {
+	cwd, _ := os.Getwd()
+	for dir := cwd; ; {
+		for _, name := range []string{"data", "Data"} {
+			candidate := filepath.Join(dir, name)
+			if len(serverDirs(candidate)) > 0 {
+				return candidate, true
+			}
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", false
+		}
+		dir = parent
+	}
+}
+
+func serverDirs(root string) []string {
+	var out []string
+	for _, server := range sortedKeys(SERVERS) {
+		if info, err := os.Stat(filepath.Join(root, server)); err == nil && info.IsDir() {
+			out = append(out, server)
+		}
+	}
+	return out
+}
+
+func scanServers(dataRoot string, patterns map[string]Pattern, fields []Field) int {
+	var (
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+		errs   []string
+		merged = make(map[string][]string)
+		counts = make(map[string]int)
+		// aggregates holds each server's inappropriate_accounts.txt, which
+		// -stream merges from instead of lines kept in memory.
+		aggregates = make(map[string]string)
+		byID       = make(map[string][]Hit)
+	)
+	sem := make(chan struct{}, MAX_SERVER_SCANS)
+
+	for _, server := range serverDirs(dataRoot) {
+		dataWWW := filepath.Join(dataRoot, server)
+		if len(listBuckets(dataWWW)) == 0 {
+			errs = append(errs, fmt.Sprintf("%s: no data.json buckets under %s", server, dataWWW))
+			continue
+		}
+
+		hitsRoot := filepath.Join(dataRoot, "Hits")
+		if server != "www" {
+			hitsRoot = filepath.Join(hitsRoot, server)
+		}
 
-	fmt.Printf("Done. Found %d accounts with slurs.\n", len(allLines))
-	fmt.Printf("TXT hits written to %s\n", hitsRoot)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			n, lines, hits := scan(server, dataWWW, "", hitsRoot, patterns, fields)
+			mu.Lock()
+			merged[server] = lines
+			counts[server] = n
+			aggregates[server] = filepath.Join(hitsRoot, "inappropriate_accounts.txt")
+			for _, h := range hits {
+				byID[h.ProfileID] = append(byID[h.ProfileID], h)
+			}
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if *provenanceOn {
+		setProvenance(filepath.Join(dataRoot, "Hits"), Provenance{
+			Server:    strings.Join(sortedKeys(merged), ","),
+			Data:      reportPath(dataRoot),
+			FlagsHash: flagsHash(),
+		})
+	}
+
+	total := 0
+	for _, n := range counts {
+		total += n
+	}
+	mergedPath := filepath.Join(dataRoot, "Hits", "all_servers_accounts.txt")
+	if *streamHits && !*appendMode {
+		writeLines(mergedPath, total, func(emit func(string)) {
+			for _, server := range sortedKeys(aggregates) {
+				eachTxtLine(aggregates[server], emit)
+			}
+		})
+	} else {
+		var all []string
+		for _, server := range sortedKeys(merged) {
+			lines := merged[server]
+			if *streamHits {
+				lines = readTxt(aggregates[server])
+			}
+			all = append(all, lines...)
+		}
+		writeTxt(mergedPath, all)
+	}
+	fmt.Printf("Merged %d accounts from %d servers into %s.\n", total, len(merged), reportPath(mergedPath))
+
+	if *masterList {
+		masterPath := filepath.Join(dataRoot, "Hits", "all_servers_master.txt")
+		writeLines(masterPath, len(byID), func(emit func(string)) {
+			for _, id := range sortedKeys(byID) {
+				emit(masterRow(id, byID[id]))
+			}
+		})
+		fmt.Printf("Wrote %d distinct profiles to %s.\n", len(byID), reportPath(masterPath))
+	}
+
+	if len(errs) > 0 {
+		fmt.Println("Errors:")
+		for _, e := range errs {
+			fmt.Println(" ", e)
+		}
+		if len(merged) == 0 {
+			os.Exit(EXIT_ERROR)
+		}
+	}
+	return total
+}
+
+// masterRow folds the hits one profile ID got on different servers into a
+// single line; the username is taken from the first server in sorted order.
+func masterRow(id string, hits []Hit) string {
+	sort.Slice(hits, func(i, j int) bool { return hits[i].Server < hits[j].Server })
+
+	var servers, flags []string
+	seen := make(map[string]struct{})
+	for _, h := range hits {
+		servers = append(servers, h.Server)
+		for _, t := range h.Terms {
+			if _, dup := seen[t]; !dup {
+				seen[t] = struct{}{}
+				flags = append(flags, t)
+			}
+		}
+	}
+	sort.Strings(flags)
+
+	return joinFields(
+		id,
+		displayName(hits[0].Username),
+		"servers=["+strings.Join(servers, ",")+"]",
+		"flags=["+strings.Join(flags, ",")+"]",
+	)
+}
+
+// boundaryMiss reports the first of terms whose pattern would have matched
+// one of the username's candidates without the word-boundary check.
+func boundaryMiss(username string, terms []string, patterns map[string]Pattern) (string, bool) {
+	cands := usernameCandidates(username)
+	for _, term := range terms {
+		for _, c := range cands {
+			if patterns[term].Loose.MatchString(c) {
+				return term, true
+			}
+		}
+	}
+	return "", false
+}
+
+func newHit(server, profileID, profileURL, username string, rank int, pages any, found []Match, scannedAt string) Hit {
+	h := Hit{
+		ProfileID:  profileID,
+		Server:     server,
+		URL:        profileURL,
+		Username:   username,
+		Normalized: foldUsername(username),
+		Terms:      []string{},
+		Categories: []string{},
+		Rank:       rank,
+		ScannedAt:  scannedAt,
+	}
+
+	cats := make(map[string]struct{})
+	for _, m := range found {
+		h.Terms = append(h.Terms, m.Flag)
+		if *debugPats {
+			h.Patterns = append(h.Patterns, m.Pattern)
+		}
+		if m.Category != "" {
+			cats[m.Category] = struct{}{}
+		}
+	}
+	h.Categories = append(h.Categories, sortedKeys(cats)...)
+
+	list, _ := pages.([]any)
+	for _, p := range list {
+		if n, ok := p.(float64); ok {
+			h.Pages = append(h.Pages, int(n))
+		}
+	}
+	return h
+}
+
+func writeHits(path string, hits []Hit) {
+	os.MkdirAll(filepath.Dir(path), 0755)
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return
+	}
+
+	w := bufio.NewWriter(f)
+	if strings.HasSuffix(path, ".ndjson") {
+		enc := json.NewEncoder(w)
+		for _, h := range hits {
+			enc.Encode(h)
+		}
+	} else {
+		if hits == nil {
+			hits = []Hit{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(hits)
+	}
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return
+	}
+	f.Close()
+	os.Rename(tmp, path)
+}
+
+func appendTrend(path, scannedAt string, total int, counts map[string]int) {
+	b, err := json.Marshal(struct {
+		ScannedAt string         `json:"scanned_at"`
+		Total     int            `json:"total"`
+		Counts    map[string]int `json:"counts"`
+	}{scannedAt, total, counts})
+	if err != nil {
+		return
+	}
+
+	os.MkdirAll(filepath.Dir(path), 0755)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	f.Write(append(b, '\n'))
+}
+
+type TermSummary struct {
+	Term    string `json:"term"`
+	Count   int    `json:"count"`
+	Example string `json:"example_username"`
+}
+
+// ForensicsStats is this tool's section of run_report.json; scans of
+// several servers add up into one.
+type ForensicsStats struct {
+	StartedAt  string         `json:"started_at"`
+	Duration   float64        `json:"duration_seconds"`
+	Servers    []string       `json:"servers"`
+	Scanned    int            `json:"profiles_scanned"`
+	Flagged    int            `json:"flagged"`
+	ByCategory map[string]int `json:"by_category"`
+}
+
+// RunReport keeps the scraper's section as raw JSON so merging ours in
+// does not drop fields this tool does not know about.
+type RunReport struct {
+	Scrape    json.RawMessage `json:"scrape,omitempty"`
+	Forensics *ForensicsStats `json:"forensics,omitempty"`
+}
+
+var (
+	runStatsMu sync.Mutex
+	runStats   = ForensicsStats{ByCategory: make(map[string]int)}
+)
+
+func recordRun(server string, scanned, flagged int, byCategory map[string]int) {
+	runStatsMu.Lock()
+	defer runStatsMu.Unlock()
+	if !slices.Contains(runStats.Servers, server) {
+		runStats.Servers = append(runStats.Servers, server)
+		sort.Strings(runStats.Servers)
+	}
+	runStats.Scanned += scanned
+	runStats.Flagged += flagged
+	for c, n := range byCategory {
+		runStats.ByCategory[c] += n
+	}
+}
+
+func writeRunReport(path string, started time.Time) {
+	var report RunReport
+	if b, err := os.ReadFile(path); err == nil {
+		if err := decodeJSON(b, &report, path); err != nil {
+			fmt.Fprintln(os.Stderr, "Warning: replacing unreadable", path)
+			report = RunReport{}
+		}
+	}
+
+	runStatsMu.Lock()
+	stats := runStats
+	runStatsMu.Unlock()
+	stats.StartedAt = started.UTC().Format(time.RFC3339)
+	stats.Duration = time.Since(started).Round(time.Millisecond).Seconds()
+	report.Forensics = &stats
+
+	os.MkdirAll(filepath.Dir(path), 0755)
+	b, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return
+	}
+	tmp := path + ".tmp"
+	if os.WriteFile(tmp, append(b, '\n'), 0644) != nil {
+		os.Remove(tmp)
+		return
+	}
+	os.Rename(tmp, path)
+}
+
+type RunSummary struct {
+	ScannedAt    string         `json:"scanned_at"`
+	Total        int            `json:"total"`
+	NoID         int            `json:"flagged_no_id"`
+	Terms        []TermSummary  `json:"terms"`
+	PagesFlagged map[string]int `json:"pages_per_flagged_account"`
+	PagesAll     map[string]int `json:"pages_per_account"`
+}
+
+var PAGE_HISTOGRAM = []struct {
+	Label string
+	Max   int
+}{
+	{"1", 1}, {"2", 2}, {"3", 3}, {"4-5", 5}, {"6-10", 10}, {"11+", 0},
+}
+
+func pagesBucket(n int) string {
+	for _, b := range PAGE_HISTOGRAM {
+		if b.Max == 0 || n <= b.Max {
+			return b.Label
+		}
+	}
+	return ""
+}
+
+func pageCount(v any) int {
+	pages, _ := v.([]any)
+	return len(pages)
+}
+
+func termSummaries(counts map[string]int, examples map[string]string) []TermSummary {
+	terms := sortedKeys(counts)
+	sort.SliceStable(terms, func(i, j int) bool {
+		return counts[terms[i]] > counts[terms[j]]
+	})
+
+	out := []TermSummary{}
+	for _, t := range terms {
+		out = append(out, TermSummary{t, counts[t], examples[t]})
+	}
+	return out
+}
+
+func writeSummary(path string, summary RunSummary) {
+	if !*quiet {
+		for _, t := range summary.Terms {
+			fmt.Fprintf(os.Stderr, "%6d  %-24s e.g. %s\n", t.Count, t.Term, t.Example)
+		}
+		fmt.Fprint(os.Stderr, "pages per flagged account:")
+		for _, b := range PAGE_HISTOGRAM {
+			fmt.Fprintf(os.Stderr, " %s=%d", b.Label, summary.PagesFlagged[b.Label])
+		}
+		fmt.Fprintln(os.Stderr)
+	}
+
+	os.MkdirAll(filepath.Dir(path), 0755)
+	b, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return
+	}
+	tmp := path + ".tmp"
+	if os.WriteFile(tmp, append(b, '\n'), 0644) != nil {
+		os.Remove(tmp)
+		return
+	}
+	os.Rename(tmp, path)
+}
+
+func urlStatus(client *http.Client, profileURL string) string {
+	var err error
+	for attempt := 1; attempt <= URL_CHECK_RETRIES; attempt++ {
+		var resp *http.Response
+		resp, err = client.Head(profileURL)
+		if err == nil {
+			resp.Body.Close()
+			switch {
+			case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+				return "gone"
+			case resp.StatusCode < 400:
+				return "live"
+			case resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500:
+				return fmt.Sprintf("unknown (status %d)", resp.StatusCode)
+			}
+			err = fmt.Errorf("status %d", resp.StatusCode)
+		}
+		if attempt < URL_CHECK_RETRIES {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+	}
+	return fmt.Sprintf("unknown (%v)", err)
+}
+
+func postBatch(client *http.Client, endpoint string, batch []Hit) error {
+	body, err := json.Marshal(map[string]any{"hits": batch})
+	if err != nil {
+		return err
+	}
+
+	for attempt := 1; attempt <= URL_CHECK_RETRIES; attempt++ {
+		var resp *http.Response
+		resp, err = client.Post(endpoint, "application/json", bytes.NewReader(body))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < 300 {
+				return nil
+			}
+			err = fmt.Errorf("status %d", resp.StatusCode)
+			if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500 {
+				return err
+			}
+		}
+		if attempt < URL_CHECK_RETRIES {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+	}
+	return err
+}
+
+func postHits(client *http.Client, endpoint string, hits []Hit) int {
+	jobs := make(chan []Hit)
+	var sent atomic.Int64
+	var wg sync.WaitGroup
+
+	for i := 0; i < WEBHOOK_WORKERS; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range jobs {
+				if err := postBatch(client, endpoint, batch); err != nil {
+					fmt.Printf("Webhook: batch of %d hits failed: %v\n", len(batch), err)
+					continue
+				}
+				sent.Add(int64(len(batch)))
+			}
+		}()
+	}
+
+	for start := 0; start < len(hits); start += WEBHOOK_BATCH {
+		jobs <- hits[start:min(start+WEBHOOK_BATCH, len(hits))]
+	}
+	close(jobs)
+	wg.Wait()
+	return int(sent.Load())
+}
+
+func checkURLs(client *http.Client, lines []string, rate float64) []string {
+	out := make([]string, len(lines))
+	jobs := make(chan int)
+
+	interval := time.Second
+	if rate > 0 {
+		interval = time.Duration(float64(time.Second) / rate)
+	}
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+
+	var wg sync.WaitGroup
+	for i := 0; i < URL_CHECK_WORKERS; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range jobs {
+				profileURL, _, _ := strings.Cut(lines[n], *delimiter)
+				out[n] = joinFields(lines[n], urlStatus(client, profileURL))
+			}
+		}()
+	}
+
+	for n := range lines {
+		<-tick.C
+		jobs <- n
+	}
+	close(jobs)
+	wg.Wait()
+	return out
+}
+
+func writeCountsCSV(path string, counts map[string]int, patterns map[string]Pattern, total int) {
+	terms := sortedKeys(counts)
+	sort.SliceStable(terms, func(i, j int) bool {
+		return counts[terms[i]] > counts[terms[j]]
+	})
+
+	os.MkdirAll(filepath.Dir(path), 0755)
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return
+	}
+
+	w := bufio.NewWriter(f)
+	fmt.Fprintf(w, "# Leaderboard Scan taken @ %s in UTC\n", utcNowISO())
+	fmt.Fprintf(w, "# Amount of Flagged Accounts: %d\n", total)
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"term", "category", "count"})
+	for _, t := range terms {
+		cw.Write([]string{t, patterns[t].Category, strconv.Itoa(counts[t])})
+	}
+	cw.Flush()
+
+	if err := w.Flush(); err != nil || cw.Error() != nil {
+		f.Close()
+		os.Remove(tmp)
+		return
+	}
+	f.Close()
+	os.Rename(tmp, path)
+}
+
+func previewNormalization(r io.Reader, w io.Writer) {
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		name := strings.TrimRight(sc.Text(), "\r")
+		if name == "" {
+			continue
+		}
+		fmt.Fprintln(w, name)
+		fmt.Fprintf(w, "  folded:     %q\n", foldUsername(name))
+		fmt.Fprint(w, "  candidates:")
+		for _, c := range usernameCandidates(name) {
+			fmt.Fprintf(w, " %q", c)
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+func explain(w io.Writer, username string, patterns map[string]Pattern) {
+	fmt.Fprintf(w, "username:   %q\n", username)
+	for _, t := range NORMALIZERS {
+		if t.Enabled {
+			fmt.Fprintf(w, "normalizer: %s\n", t.Name)
+		}
+	}
+	folded := foldUsername(username)
+	fmt.Fprintf(w, "folded:     %q\n", folded)
+	for _, t := range CANDIDATES {
+		if t.Enabled {
+			fmt.Fprintf(w, "candidate:  %-12s %q\n", t.Name, t.Fn(t.input(username, folded)))
+		}
+	}
+
+	candidates := usernameCandidates(username)
+	hits := 0
+	for _, term := range sortedKeys(patterns) {
+		re := patterns[term].Re
+		matched := false
+		for _, c := range candidates {
+			if loc := re.FindStringIndex(c); loc != nil {
+				fmt.Fprintf(w, "match:      %-16s in %q -> %q\n", term, c, c[loc[0]:loc[1]])
+				matched = true
+				break
+			}
+		}
+		if matched {
+			hits++
+		} else {
+			fmt.Fprintf(w, "no match:   %s\n", term)
+		}
+	}
+	fmt.Fprintf(w, "result:     %d of %d terms matched\n", hits, len(patterns))
+}
+
+// exitNoData ends a run that found nothing to scan; -allow-missing turns it
+// into a clean exit so pipelines over empty servers keep going.
+func exitNoData(msg string) {
+	if *allowMissing {
+		fmt.Fprintln(os.Stderr, "Warning:", msg+"; nothing to scan.")
+		os.Exit(EXIT_CLEAN)
+	}
+	fmt.Println(msg)
+	os.Exit(EXIT_NO_DATA)
+}
+
+func main() {
+	flag.Parse()
+	started := time.Now()
+
+	if err := configureTransforms(*enableTf, *disableTf); err != nil {
+		fmt.Println(err)
+		os.Exit(EXIT_ERROR)
+	}
+
+	var err error
+	if fieldMap, err = parseFieldMap(*fieldMapSpec); err != nil {
+		fmt.Println(err)
+		os.Exit(EXIT_ERROR)
+	}
+
+	if *normalizeOnly {
+		previewNormalization(os.Stdin, os.Stdout)
+		return
+	}
+
+	if *flatOutput && (*categoryTree || *countsCSV || *streamHits) {
+		fmt.Println("-flat cannot be combined with -by-category, -counts-csv or -stream, which need the per-slur collections")
+		os.Exit(EXIT_ERROR)
+	}
+	if *streamHits && (*categoryTree || *byRank || *verifyURLs) {
+		fmt.Println("-stream cannot be combined with -by-category, -by-rank or -verify-urls")
+		os.Exit(EXIT_ERROR)
+	}
+	if *byRank && *appendMode {
+		fmt.Println("-by-rank cannot be combined with -append, which would add hits after the rank sections")
+		os.Exit(EXIT_ERROR)
+	}
+
+	if *minRank < 0 || *maxRank < 0 || (*maxRank > 0 && *minRank > *maxRank) {
+		fmt.Println("-min-rank and -max-rank must be positive with -min-rank <= -max-rank")
+		os.Exit(EXIT_ERROR)
+	}
+
+	if *diffRoot != "" {
+		if info, err := os.Stat(*diffRoot); err != nil || !info.IsDir() {
+			fmt.Println("Could not open", *diffRoot)
+			os.Exit(EXIT_ERROR)
+		}
+	}
+
+	if *watchEvery > 0 && (*ndjsonIn == "-" || *failOnHits) {
+		fmt.Println("-watch cannot be combined with -input-ndjson=- or -fail-on-hits")
+		os.Exit(EXIT_ERROR)
+	}
+
+	if *resume && *ndjsonIn != "" {
+		fmt.Println("-resume cannot be combined with -input-ndjson, which has no bucket directories to checkpoint")
+		os.Exit(EXIT_ERROR)
+	}
+	if *countOnly && (*resume || *watchEvery > 0 || *parallelSrv) {
+		fmt.Println("-count-only cannot be combined with -resume, -watch or -parallel-servers")
+		os.Exit(EXIT_ERROR)
+	}
+
+	if *dataName == "" || filepath.Base(*dataName) != *dataName {
+		fmt.Println("-data-file must be a plain file name")
+		os.Exit(EXIT_ERROR)
+	}
+
+	if *delimiter == "" || strings.ContainsAny(*delimiter, "\r\n") {
+		fmt.Println("-delimiter must be non-empty and must not contain line breaks")
+		os.Exit(EXIT_ERROR)
+	}
+	if *maxNameLen < 0 || *maxCands < 0 || *maxCandLen < 0 || *maxEntries < 0 {
+		fmt.Println("-max-name-length, -max-candidates, -max-candidate-length and -max-entries-per-bucket must not be negative")
+		os.Exit(EXIT_ERROR)
+	}
+
+	if *minFlags < 1 {
+		fmt.Println("-min-flags must be at least 1")
+		os.Exit(EXIT_ERROR)
+	}
+
+	switch *hitsFormat {
+	case "", "json", "ndjson":
+	default:
+		fmt.Println("-hits-format must be json or ndjson")
+		os.Exit(EXIT_ERROR)
+	}
+	if *verifyRate <= 0 {
+		fmt.Println("-verify-rate must be positive")
+		os.Exit(EXIT_ERROR)
+	}
+	if *debugPats && *hitsFormat == "" {
+		fmt.Println("-debug-patterns needs -hits-format")
+		os.Exit(EXIT_ERROR)
+	}
+
+	if *explainName != "" {
+		explain(os.Stdout, *explainName, compilePatterns(fetchSlurs()))
+		return
+	}
+
+	if *masterList && !*parallelSrv {
+		fmt.Println("-master needs -parallel-servers")
+		os.Exit(EXIT_ERROR)
+	}
+
+	if *parallelSrv {
+		if *ndjsonIn != "" || *archiveIn != "" || *scanPath != "" || *diffRoot != "" {
+			fmt.Println("-parallel-servers cannot be combined with -input-ndjson, -archive, -dir or -diff")
+			os.Exit(EXIT_ERROR)
+		}
+
+		dataRoot, ok := findDataRoot()
+		if !ok {
+			exitNoData("Could not locate a data directory with server subdirectories")
+		}
+		if *relPaths {
+			reportBase = dataRoot
+		}
+
+		patterns := compilePatterns(fetchSlurs())
+		fields := parseFields(*fieldSpec)
+
+		detectCache = newDetectLRU(*cacheSize)
+		total := scanServers(dataRoot, patterns, fields)
+		if *runReport != "" {
+			writeRunReport(*runReport, started)
+		}
+
+		if *watchEvery > 0 {
+			watchFlags(func(p map[string]Pattern) {
+				detectCache = newDetectLRU(*cacheSize)
+				scanServers(dataRoot, p, fields)
+			})
+		}
+
+		if *failOnHits && total > *hitLimit {
+			os.Exit(EXIT_HITS)
+		}
+		return
+	}
+
+	if *archiveIn != "" && (*ndjsonIn != "" || *scanPath != "" || *resume) {
+		fmt.Println("-archive cannot be combined with -input-ndjson, -dir or -resume")
+		os.Exit(EXIT_ERROR)
+	}
+
+	var dataWWW, single, hitsRoot, archiveServer string
+	if *archiveIn != "" {
+		abs, _ := filepath.Abs(*archiveIn)
+		m, err := readManifest(abs)
+		if err != nil {
+			fmt.Println("Could not read", *archiveIn+":", err)
+			os.Exit(EXIT_ERROR)
+		}
+		archiveServer = m.Server
+		hitsRoot = filepath.Join(filepath.Dir(abs), "Hits")
+	} else if *ndjsonIn != "" {
+		base, _ := os.Getwd()
+		if *ndjsonIn != "-" {
+			abs, _ := filepath.Abs(*ndjsonIn)
+			base = filepath.Dir(abs)
+		}
+		hitsRoot = filepath.Join(base, "Hits")
+	} else if *scanPath != "" {
+		info, err := os.Stat(*scanPath)
+		if err != nil {
+			fmt.Println("Could not open", *scanPath)
+			os.Exit(EXIT_ERROR)
+		}
+		single, _ = filepath.Abs(*scanPath)
+		if info.IsDir() {
+			single = filepath.Join(single, *dataName)
+		}
+		dataWWW = filepath.Dir(filepath.Dir(single))
+	} else {
+		var ok bool
+		dataWWW, ok = findDataWWW()
+		if !ok {
+			exitNoData("Could not locate data/www")
+		}
+	}
+
+	server := *serverName
+	if server == "auto" && archiveServer != "" {
+		server = archiveServer
+	} else if server == "auto" {
+		origin := dataWWW
+		if *ndjsonIn != "" && *ndjsonIn != "-" {
+			origin, _ = filepath.Abs(*ndjsonIn)
+		}
+		var ok bool
+		if server, ok = detectServer(origin); !ok {
+			fmt.Fprintln(os.Stderr, "Warning: could not infer the server from the data path; assuming www.")
+			server = "www"
+		}
+	}
+	if _, ok := SERVERS[server]; !ok {
+		fmt.Println("Unknown server:", server)
+		os.Exit(EXIT_ERROR)
+	}
+
+	if hitsRoot == "" {
+		hitsRoot = filepath.Join(filepath.Dir(dataWWW), "Hits")
+	}
+	if *relPaths {
+		reportBase = filepath.Dir(hitsRoot)
+	}
+	if server != "www" {
+		hitsRoot = filepath.Join(hitsRoot, server)
+	}
+
+	patterns := compilePatterns(fetchSlurs())
+	fields := parseFields(*fieldSpec)
+
+	detectCache = newDetectLRU(*cacheSize)
+	total, _, _ := scan(server, dataWWW, single, hitsRoot, patterns, fields)
+	if *runReport != "" {
+		writeRunReport(*runReport, started)
+	}
+
+	if *watchEvery > 0 {
+		watchFlags(func(p map[string]Pattern) {
+			detectCache = newDetectLRU(*cacheSize)
+			scan(server, dataWWW, single, hitsRoot, p, fields)
+		})
+	}
+
+	if *failOnHits && total > *hitLimit {
+		os.Exit(EXIT_HITS)
+	}
 }
@@ -0,0 +1,2802 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testFlags = `{"PROFANITY": ["crap", "darn"], "INSULTS": ["loser"]}`
+
+func setFlag[T any](t testing.TB, p *T, v T) {
+	t.Helper()
+	old := *p
+	*p = v
+	t.Cleanup(func() { *p = old })
+}
+
+// fixture is a scratch data/www tree with its own flags.json; it becomes the
+// working directory for the rest of the test.
+type fixture struct {
+	root    string
+	dataWWW string
+	hits    string
+}
+
+func newFixture(t *testing.T, flags string) *fixture {
+	t.Helper()
+	root := t.TempDir()
+	t.Chdir(root)
+	if err := os.WriteFile(SLURS_JSON, []byte(flags), 0644); err != nil {
+		t.Fatal(err)
+	}
+	setFlag(t, quiet, true)
+	setFlag(t, &detectCache, nil)
+	return &fixture{
+		root:    root,
+		dataWWW: filepath.Join(root, "data", "www"),
+		hits:    filepath.Join(root, "data", "Hits"),
+	}
+}
+
+func (f *fixture) bucket(t *testing.T, name string, entries map[string]any) string {
+	t.Helper()
+	dir := filepath.Join(f.dataWWW, name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, *dataName)
+	if err := os.WriteFile(path, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func (f *fixture) patterns(t *testing.T) map[string]Pattern {
+	t.Helper()
+	slurs, err := loadSlurs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return compilePatterns(slurs)
+}
+
+func (f *fixture) scan(t *testing.T) ([]string, []Hit) {
+	t.Helper()
+	_, lines, hits := scan("www", f.dataWWW, "", f.hits, f.patterns(t), parseFields(*fieldSpec))
+	return lines, hits
+}
+
+func transform(t *testing.T, name string) *Transform {
+	t.Helper()
+	for _, list := range [][]*Transform{NORMALIZERS, CANDIDATES} {
+		for _, tf := range list {
+			if tf.Name == name {
+				return tf
+			}
+		}
+	}
+	t.Fatalf("no transform named %q", name)
+	return nil
+}
+
+func entry(id any, username string, rank int, pages ...int) map[string]any {
+	list := []any{}
+	for _, p := range pages {
+		list = append(list, p)
+	}
+	return map[string]any{
+		"latest": map[string]any{"id": id, "username": username, "rank": rank},
+		"pages":  list,
+	}
+}
+
+func headerCount(t *testing.T, path string) string {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range strings.Split(string(b), "\n") {
+		if n, ok := strings.CutPrefix(l, "Amount of Flagged Accounts in file: "); ok {
+			return n
+		}
+	}
+	t.Fatalf("%s has no count in its header", path)
+	return ""
+}
+
+func TestAppendDeduplicatesByProfileID(t *testing.T) {
+	setFlag(t, appendMode, true)
+	path := filepath.Join(t.TempDir(), "inappropriate_accounts.txt")
+
+	writeTxt(path, []string{
+		"https://www.kogama.com/profile/1/ | crapper",
+		"https://www.kogama.com/profile/2/ | loser",
+	})
+	writeTxt(path, []string{
+		"https://www.kogama.com/profile/2/ | loser",
+		"https://www.kogama.com/profile/3/ | darnit",
+	})
+
+	lines := readTxt(path)
+	want := []string{
+		"https://www.kogama.com/profile/1/ | crapper",
+		"https://www.kogama.com/profile/2/ | loser",
+		"https://www.kogama.com/profile/3/ | darnit",
+	}
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("lines after two appends = %q, want %q", lines, want)
+	}
+	if n := headerCount(t, path); n != "3" {
+		t.Fatalf("header count = %s, want 3", n)
+	}
+}
+
+func TestDedupIsByProfileID(t *testing.T) {
+	tests := []struct {
+		name    string
+		buckets map[string]map[string]any
+		want    int
+	}{
+		{
+			name: "same username, different IDs",
+			buckets: map[string]map[string]any{
+				"1to20000": {"a": entry(1, "loser", 1), "b": entry(2, "loser", 2)},
+			},
+			want: 2,
+		},
+		{
+			name: "same ID seen again in another bucket",
+			buckets: map[string]map[string]any{
+				"1to20000":     {"a": entry(1, "loser", 1)},
+				"20001to40000": {"a": entry(1, "loser", 20001)},
+			},
+			want: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFixture(t, testFlags)
+			for name, entries := range tt.buckets {
+				f.bucket(t, name, entries)
+			}
+			lines, _ := f.scan(t)
+			if len(lines) != tt.want {
+				t.Fatalf("got %d aggregate lines, want %d: %q", len(lines), tt.want, lines)
+			}
+			collection := filepath.Join(f.hits, "inappropriate_accounts_collections", "txt", "INSULTS", "slur_loser.txt")
+			if got := readTxt(collection); len(got) != tt.want {
+				t.Fatalf("got %d collection lines, want %d: %q", len(got), tt.want, got)
+			}
+		})
+	}
+}
+
+func syntheticFlags(n int) map[string]Flag {
+	out := make(map[string]Flag, n)
+	for i := 0; i < n; i++ {
+		out[fmt.Sprintf("term%sword%d", strings.Repeat("x", i%7), i)] = Flag{Category: fmt.Sprintf("cat%d", i%5)}
+	}
+	return out
+}
+
+func patternStrings(ps map[string]Pattern) map[string]string {
+	out := make(map[string]string, len(ps))
+	for k, p := range ps {
+		out[k] = p.Re.String() + "\x00" + p.Strict.String() + "\x00" + p.Category
+		if p.Loose != nil {
+			out[k] += "\x00" + p.Loose.String()
+		}
+	}
+	return out
+}
+
+func TestCompilePatternsMatchesSerial(t *testing.T) {
+	setFlag(t, quiet, true)
+	slurs := syntheticFlags(500)
+
+	setFlag(t, threads, 1)
+	serial := patternStrings(compilePatterns(slurs))
+	*threads = 8
+	parallel := patternStrings(compilePatterns(slurs))
+
+	if !maps.Equal(serial, parallel) {
+		t.Fatal("parallel compilation produced a different pattern map than the serial one")
+	}
+}
+
+func BenchmarkCompilePatterns(b *testing.B) {
+	setFlag(b, quiet, true)
+	slurs := syntheticFlags(5000)
+
+	setFlag(b, threads, 1)
+	want := patternStrings(compilePatterns(slurs))
+
+	for _, n := range []int{1, max(4, runtime.NumCPU())} {
+		b.Run(fmt.Sprintf("threads=%d", n), func(b *testing.B) {
+			*threads = n
+			if got := patternStrings(compilePatterns(slurs)); !maps.Equal(got, want) {
+				b.Fatalf("threads=%d produced a different pattern map", n)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				compilePatterns(slurs)
+			}
+		})
+	}
+}
+
+func TestRawRegexFlags(t *testing.T) {
+	f := newFixture(t, `{"MISC": ["crap", {"regex": "l[o0]+s[e3]r"}]}`)
+	patterns := f.patterns(t)
+
+	tests := []struct {
+		username string
+		want     []string
+	}{
+		{"cr4p", []string{"crap"}},
+		{"LOOOS3R", []string{"l[o0]+s[e3]r"}},
+		{"l0s3r and crap", []string{"crap", "l[o0]+s[e3]r"}},
+		{"clean", nil},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, m := range detect(tt.username, patterns) {
+			got = append(got, m.Flag)
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("detect(%q) = %v, want %v", tt.username, got, tt.want)
+		}
+	}
+	if !patterns["l[o0]+s[e3]r"].Re.MatchString("xloserx") {
+		t.Error("raw regex should be compiled verbatim, without word boundaries")
+	}
+}
+
+func TestInvalidRawRegexIsReported(t *testing.T) {
+	newFixture(t, `{"MISC": ["crap", {"regex": "bad(["}]}`)
+	_, err := loadSlurs()
+	if err == nil || !strings.Contains(err.Error(), `"bad(["`) {
+		t.Fatalf("loadSlurs error = %v, want it to name the bad regex", err)
+	}
+}
+
+func TestWriteLinesRenamesAtomically(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "inappropriate_accounts.txt")
+	writeTxt(path, []string{"old"})
+
+	writeLines(path, 2, func(emit func(string)) {
+		emit("new 1")
+		if got := readTxt(path); len(got) != 1 || got[0] != "old" {
+			t.Errorf("destination changed mid-write: %q", got)
+		}
+		if _, err := os.Stat(path + ".tmp"); err != nil {
+			t.Errorf("lines are not written to a temp file: %v", err)
+		}
+		emit("new 2")
+	})
+
+	if got := readTxt(path); strings.Join(got, ",") != "new 1,new 2" {
+		t.Fatalf("after rename got %q", got)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("temp file left behind: %v", err)
+	}
+}
+
+func TestStreamedAggregateMatchesBuffered(t *testing.T) {
+	f := newFixture(t, testFlags)
+	f.bucket(t, "1to20000", map[string]any{
+		"a": entry(1, "crap", 1),
+		"b": entry(2, "loser", 2),
+		"c": entry(3, "clean", 3),
+	})
+	aggregate := filepath.Join(f.hits, "inappropriate_accounts.txt")
+
+	buffered, _ := f.scan(t)
+	want := readTxt(aggregate)
+
+	setFlag(t, streamHits, true)
+	n, lines, _ := scan("www", f.dataWWW, "", f.hits, f.patterns(t), parseFields(*fieldSpec))
+	if lines != nil {
+		t.Errorf("-stream kept %d aggregate lines in memory", len(lines))
+	}
+	if n != len(buffered) {
+		t.Errorf("-stream counted %d accounts, want %d", n, len(buffered))
+	}
+	got := readTxt(aggregate)
+	slices.Sort(got)
+	slices.Sort(want)
+	if !slices.Equal(got, want) {
+		t.Fatalf("streamed aggregate = %q, want %q", got, want)
+	}
+	if c := headerCount(t, aggregate); c != "2" {
+		t.Fatalf("streamed header count = %s, want 2", c)
+	}
+}
+
+func TestCategoryPropagation(t *testing.T) {
+	f := newFixture(t, testFlags)
+	f.bucket(t, "1to20000", map[string]any{"a": entry(1, "crap_loser", 1)})
+
+	got := detect("crap_loser", f.patterns(t))
+	want := []Match{{Flag: "crap", Category: "PROFANITY"}, {Flag: "loser", Category: "INSULTS"}}
+	if len(got) != len(want) {
+		t.Fatalf("detect = %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i].Flag != want[i].Flag || got[i].Category != want[i].Category {
+			t.Fatalf("detect = %+v, want %+v", got, want)
+		}
+	}
+
+	setFlag(t, hitsFormat, "json")
+	_, hits := f.scan(t)
+	if len(hits) != 1 || strings.Join(hits[0].Categories, ",") != "INSULTS,PROFANITY" {
+		t.Fatalf("hit categories = %+v", hits)
+	}
+
+	collections := filepath.Join(f.hits, "inappropriate_accounts_collections", "txt")
+	for _, p := range []string{"PROFANITY/slur_crap.txt", "INSULTS/slur_loser.txt"} {
+		if len(readTxt(filepath.Join(collections, p))) != 1 {
+			t.Errorf("%s does not hold the hit", p)
+		}
+	}
+
+	os.RemoveAll(f.hits)
+	setFlag(t, noCategory, true)
+	f.scan(t)
+	for _, p := range []string{"slur_crap.txt", "slur_loser.txt"} {
+		if len(readTxt(filepath.Join(collections, p))) != 1 {
+			t.Errorf("-no-categories: %s does not hold the hit", p)
+		}
+	}
+}
+
+func TestStrictFieldsUseWholeTokens(t *testing.T) {
+	f := newFixture(t, testFlags)
+	patterns := f.patterns(t)
+	fields := parseFields("username,about:strict")
+
+	tests := []struct {
+		name     string
+		username string
+		about    string
+		want     int
+	}{
+		{"spaced username is loose", "c r a p", "", 1},
+		{"spaced about is strict", "clean", "c r a p", 0},
+		{"whole word about", "clean", "what crap", 1},
+		{"leet about", "clean", "what cr4p", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			latest := map[string]any{"username": tt.username, "about": tt.about}
+			if got := matchEntry(latest, tt.username, patterns, fields); len(got) != tt.want {
+				t.Fatalf("matchEntry = %+v, want %d matches", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecoratedHandles(t *testing.T) {
+	f := newFixture(t, testFlags)
+	patterns := f.patterns(t)
+
+	tests := []struct {
+		username string
+		flagged  bool
+	}{
+		{"xX_crap_Xx", true},
+		{"...crap...", true},
+		{"xXx__L0SER__xXx", true},
+		{"[[darn]]", true},
+		{"xcrapx", false},
+		{"xX_scrapper_Xx", false},
+	}
+	for _, tt := range tests {
+		if got := len(detect(tt.username, patterns)) > 0; got != tt.flagged {
+			t.Errorf("detect(%q) flagged = %v, want %v", tt.username, got, tt.flagged)
+		}
+	}
+	if got := stripDecoration("xx_crap_xx"); got != "crap" {
+		t.Errorf("stripDecoration = %q, want crap", got)
+	}
+}
+
+func TestReloadFlagsPicksUpNewTerms(t *testing.T) {
+	newFixture(t, testFlags)
+	stamp := flagsStamp()
+	if _, ok := reloadFlags(&stamp); ok {
+		t.Fatal("reloadFlags reported a change for an untouched flags.json")
+	}
+
+	if err := os.WriteFile(SLURS_JSON, []byte(`{"PROFANITY": ["crap", "darn", "heck"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	patterns, ok := reloadFlags(&stamp)
+	if !ok {
+		t.Fatal("reloadFlags missed the edited flags.json")
+	}
+	if len(detect("heck_yeah", patterns)) != 1 {
+		t.Fatal("the new term does not match after reloading")
+	}
+	if _, ok := reloadFlags(&stamp); ok {
+		t.Fatal("reloadFlags reported the same change twice")
+	}
+}
+
+func TestProfileIDRepresentations(t *testing.T) {
+	tests := []struct {
+		name     string
+		in       any
+		id       string
+		fallback bool
+		ok       bool
+	}{
+		{"float", 12345.0, "12345", false, true},
+		{"numeric string", " 12345 ", "12345", false, true},
+		{"non-numeric string", "abc 12", "abc%2012", true, true},
+		{"empty string", "", "", false, false},
+		{"missing", nil, "", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, fallback, ok := profileIDOf(tt.in)
+			if id != tt.id || fallback != tt.fallback || ok != tt.ok {
+				t.Fatalf("profileIDOf(%v) = %q, %v, %v; want %q, %v, %v", tt.in, id, fallback, ok, tt.id, tt.fallback, tt.ok)
+			}
+		})
+	}
+}
+
+func TestStringIDsAreNotDropped(t *testing.T) {
+	f := newFixture(t, testFlags)
+	f.bucket(t, "1to20000", map[string]any{
+		"a": entry(1.0, "crap", 1),
+		"b": entry("2", "crap", 2),
+		"c": entry("user-3", "crap", 3),
+	})
+	lines, _ := f.scan(t)
+	want := []string{
+		"https://www.kogama.com/profile/1/ | crap",
+		"https://www.kogama.com/profile/2/ | crap",
+		"https://www.kogama.com/profile/user-3/ | crap",
+	}
+	slices.Sort(lines)
+	if !slices.Equal(lines, want) {
+		t.Fatalf("lines = %q, want %q", lines, want)
+	}
+}
+
+func TestSampleIsSeeded(t *testing.T) {
+	var files []string
+	for i := 0; i < 50; i++ {
+		files = append(files, fmt.Sprintf("%dto%d/data.json", i*BUCKET_SIZE+1, (i+1)*BUCKET_SIZE))
+	}
+
+	tests := []struct {
+		spec string
+		want int
+	}{
+		{"10", 10},
+		{"0.2", 10},
+		{"500", 50},
+	}
+	for _, tt := range tests {
+		a, err := sampleBuckets(files, tt.spec, 42)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := sampleBuckets(files, tt.spec, 42)
+		if len(a) != tt.want || !slices.Equal(a, b) {
+			t.Errorf("-sample=%s: got %d files, same seed equal = %v", tt.spec, len(a), slices.Equal(a, b))
+		}
+	}
+
+	a, _ := sampleBuckets(files, "10", 1)
+	b, _ := sampleBuckets(files, "10", 2)
+	if slices.Equal(a, b) {
+		t.Error("different seeds picked the same sample")
+	}
+	for _, bad := range []string{"0", "-3", "1.5", "x"} {
+		if _, err := sampleBuckets(files, bad, 1); err == nil {
+			t.Errorf("-sample=%s was accepted", bad)
+		}
+	}
+}
+
+func TestLineEndingsAndBOM(t *testing.T) {
+	tests := []struct {
+		name      string
+		crlf, bom bool
+	}{
+		{"default", false, false},
+		{"crlf", true, false},
+		{"bom", false, true},
+		{"crlf and bom", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, crlf, tt.crlf)
+			setFlag(t, bom, tt.bom)
+			path := filepath.Join(t.TempDir(), "out.txt")
+			writeTxt(path, []string{"a | ünïcode", "b | name"})
+
+			b, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			text := string(b)
+			wantBOM := 0
+			if tt.bom {
+				wantBOM = 1
+			}
+			if n := strings.Count(text, "\ufeff"); n != wantBOM || (tt.bom && !strings.HasPrefix(text, "\ufeff")) {
+				t.Errorf("file has %d BOMs, want %d at the start", n, wantBOM)
+			}
+			crlfs, lfs := strings.Count(text, "\r\n"), strings.Count(text, "\n")
+			if tt.crlf && crlfs != lfs {
+				t.Errorf("%d of %d line endings are CRLF", crlfs, lfs)
+			}
+			if !tt.crlf && crlfs != 0 {
+				t.Errorf("found %d CRLF endings without -crlf", crlfs)
+			}
+			if got := readTxt(path); strings.Join(got, ",") != "a | ünïcode,b | name" {
+				t.Errorf("readTxt = %q", got)
+			}
+		})
+	}
+}
+
+func TestSpacedOutSpellings(t *testing.T) {
+	f := newFixture(t, testFlags)
+	patterns := f.patterns(t)
+
+	for _, name := range []string{"c r a p", "c  r  a  p", "c\tr\ta\tp", "C R 4 P", "l o s e r 99", "the d a r n kid"} {
+		if len(detect(name, patterns)) == 0 {
+			t.Errorf("detect(%q) missed the spaced-out term", name)
+		}
+	}
+	if got := transform(t, "spaceless").Fn(foldUsername("c r\ta p")); got != "crap" {
+		t.Errorf("spaceless candidate = %q, want crap", got)
+	}
+}
+
+func TestCustomTransform(t *testing.T) {
+	f := newFixture(t, testFlags)
+	patterns := f.patterns(t)
+
+	old := CANDIDATES
+	t.Cleanup(func() { CANDIDATES = old })
+	CANDIDATES = append(append([]*Transform(nil), old...), &Transform{
+		Name: "reversed",
+		Fn: func(s string) string {
+			r := []rune(s)
+			slices.Reverse(r)
+			return string(r)
+		},
+	})
+
+	if slices.Contains(usernameCandidates("parc"), "crap") {
+		t.Fatal("a disabled transform produced a candidate")
+	}
+	if err := configureTransforms("reversed", ""); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(usernameCandidates("parc"), "crap") || len(detect("parc", patterns)) != 1 {
+		t.Fatal("the enabled custom transform was not applied")
+	}
+	if err := configureTransforms("", "reversed"); err != nil {
+		t.Fatal(err)
+	}
+	if len(detect("parc", patterns)) != 0 {
+		t.Fatal("the custom transform still applies after disabling it")
+	}
+	if err := configureTransforms("nonexistent", ""); err == nil {
+		t.Fatal("an unknown transform name was accepted")
+	}
+}
+
+func TestEmojiNormalizer(t *testing.T) {
+	f := newFixture(t, testFlags)
+	patterns := f.patterns(t)
+	name := "🇨🇷🇦🇵"
+	if len(detect(name, patterns)) != 0 {
+		t.Fatal("the emoji normalizer should be off by default")
+	}
+	emoji := transform(t, "emoji")
+	setFlag(t, &emoji.Enabled, true)
+	if len(detect(name, patterns)) != 1 {
+		t.Fatal("regional indicator letters were not mapped with emoji enabled")
+	}
+}
+
+func TestSingleFileStoreIsScanned(t *testing.T) {
+	f := newFixture(t, testFlags)
+	f.bucket(t, ".", map[string]any{
+		"1": entry(1, "crap", 1),
+		"2": entry(2, "clean", 50000),
+	})
+	if lines, _ := f.scan(t); len(lines) != 1 {
+		t.Fatalf("scanning a single-file store flagged %d accounts, want 1", len(lines))
+	}
+}
+
+func TestMixedScript(t *testing.T) {
+	tests := []struct {
+		username string
+		want     bool
+	}{
+		{"crap", false},
+		{"сrap", true},       // Cyrillic с
+		{"lοser", true},      // Greek ο
+		{"ivan иван", false}, // each word is a single script
+		{"привет", false},
+		{"名前abc", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := mixedScript(tt.username); got != tt.want {
+			t.Errorf("mixedScript(%q) = %v, want %v", tt.username, got, tt.want)
+		}
+	}
+
+	f := newFixture(t, testFlags)
+	setFlag(t, scriptMix, true)
+	f.bucket(t, "1to20000", map[string]any{
+		"a": entry(1, "pаypal", 1),
+		"b": entry(2, "paypal", 2),
+	})
+	lines, _ := f.scan(t)
+	if len(lines) != 0 {
+		t.Fatalf("script mixing alone produced confirmed hits: %q", lines)
+	}
+	got := readTxt(filepath.Join(f.hits, "suspicious_script_mixing.txt"))
+	if len(got) != 1 || !strings.Contains(got[0], "/profile/1/") {
+		t.Fatalf("suspicious_script_mixing.txt = %q", got)
+	}
+}
+
+func TestCountsCSVMatchesCollections(t *testing.T) {
+	f := newFixture(t, testFlags)
+	setFlag(t, countsCSV, true)
+	f.bucket(t, "1to20000", map[string]any{
+		"a": entry(1, "crap", 1),
+		"b": entry(2, "crap_loser", 2),
+		"c": entry(3, "cr4p", 3),
+		"d": entry(4, "darn", 4),
+		"e": entry(5, "clean", 5),
+	})
+	f.scan(t)
+
+	b, err := os.ReadFile(filepath.Join(f.hits, "slur_counts.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := string(b)
+	if !strings.Contains(text, "# Amount of Flagged Accounts: 4\n") {
+		t.Errorf("CSV header lacks the total:\n%s", text)
+	}
+	r := csv.NewReader(strings.NewReader(text))
+	r.Comment = '#'
+	rows, err := r.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	collections := filepath.Join(f.hits, "inappropriate_accounts_collections", "txt")
+	var order []string
+	for _, row := range rows[1:] {
+		term, category, count := row[0], row[1], row[2]
+		order = append(order, term)
+		n := len(readTxt(filepath.Join(collections, category, "slur_"+term+".txt")))
+		if strconv.Itoa(n) != count {
+			t.Errorf("%s: CSV count %s, collection has %d lines", term, count, n)
+		}
+	}
+	if strings.Join(order, ",") != "crap,darn,loser" {
+		t.Errorf("CSV order = %v, want most frequent first", order)
+	}
+}
+
+// repeatedUsernames cycles a small pool of names, the way popular handles
+// recur across a full leaderboard.
+func repeatedUsernames(n int) []string {
+	pool := []string{"crap", "xX_L0SER_Xx", "clean_player", "d a r n", "Cr4pMaster", "nice.guy", "l00ser99", "ordinary"}
+	out := make([]string, n)
+	for i := range out {
+		out[i] = pool[i%len(pool)] + strconv.Itoa(i%13)
+	}
+	return out
+}
+
+func detectAll(names []string, patterns map[string]Pattern) [][]Match {
+	out := make([][]Match, len(names))
+	for i, name := range names {
+		out[i] = detect(name, patterns)
+	}
+	return out
+}
+
+func TestDetectLRU(t *testing.T) {
+	c := newDetectLRU(2)
+	c.Put("a", []Match{{Flag: "a"}})
+	c.Put("b", []Match{{Flag: "b"}})
+	c.Get("a")
+	c.Put("c", []Match{{Flag: "c"}})
+	if _, ok := c.Get("b"); ok {
+		t.Error("the least recently used entry was not evicted")
+	}
+	if _, ok := c.Get("a"); !ok {
+		t.Error("a recently used entry was evicted")
+	}
+	if newDetectLRU(0) != nil {
+		t.Error("-cache-size 0 should disable the cache")
+	}
+
+	f := newFixture(t, testFlags)
+	patterns := f.patterns(t)
+	names := repeatedUsernames(500)
+	uncached := detectAll(names, patterns)
+	detectCache = newDetectLRU(16)
+	if cached := detectAll(names, patterns); fmt.Sprint(cached) != fmt.Sprint(uncached) {
+		t.Fatal("cached detection differs from the uncached path")
+	}
+}
+
+func BenchmarkDetectCache(b *testing.B) {
+	setFlag(b, quiet, true)
+	setFlag(b, &detectCache, nil)
+	patterns := compilePatterns(syntheticFlags(300))
+	names := repeatedUsernames(2000)
+	want := fmt.Sprint(detectAll(names, patterns))
+
+	for _, size := range []int{0, 1000} {
+		b.Run(fmt.Sprintf("cache=%d", size), func(b *testing.B) {
+			detectCache = newDetectLRU(size)
+			if got := fmt.Sprint(detectAll(names, patterns)); got != want {
+				b.Fatalf("cache=%d changed the detection results", size)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				detectAll(names, patterns)
+			}
+		})
+	}
+}
+
+// captureStderr returns what fn writes to os.Stderr.
+func captureStderr(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := os.Stderr
+	os.Stderr = w
+	defer func() { os.Stderr = old }()
+
+	out := make(chan string)
+	go func() {
+		b, _ := io.ReadAll(r)
+		out <- string(b)
+	}()
+	fn()
+	w.Close()
+	return <-out
+}
+
+func TestNDJSONInput(t *testing.T) {
+	tests := []struct {
+		name      string
+		user, id  string
+		input     string
+		want      []string
+		malformed string
+	}{
+		{
+			name:  "default fields",
+			user:  "username",
+			id:    "id",
+			input: `{"username": "crap", "id": 1}` + "\n" + `{"username": "clean", "id": 2}` + "\n",
+			want:  []string{"https://www.kogama.com/profile/1/ | crap"},
+		},
+		{
+			name:  "renamed fields",
+			user:  "handle",
+			id:    "uid",
+			input: `{"handle": "l0ser", "uid": "7"}` + "\n",
+			want:  []string{"https://www.kogama.com/profile/7/ | l0ser"},
+		},
+		{
+			name:  "BOM on the first line",
+			user:  "username",
+			id:    "id",
+			input: "\ufeff" + `{"username": "darn", "id": 3}` + "\r\n",
+			want:  []string{"https://www.kogama.com/profile/3/ | darn"},
+		},
+		{
+			name:      "malformed lines are counted",
+			user:      "username",
+			id:        "id",
+			input:     `{"username": "crap", "id": 1}` + "\n{not json\n\n[1, 2]\n" + `{"username": "darn", "id": 4}` + "\n",
+			want:      []string{"https://www.kogama.com/profile/1/ | crap", "https://www.kogama.com/profile/4/ | darn"},
+			malformed: "skipped 2 malformed lines in accounts.ndjson (first at line 2)",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFixture(t, testFlags)
+			if err := os.WriteFile("accounts.ndjson", []byte(tt.input), 0644); err != nil {
+				t.Fatal(err)
+			}
+			setFlag(t, ndjsonIn, "accounts.ndjson")
+			setFlag(t, ndUser, tt.user)
+			setFlag(t, ndID, tt.id)
+
+			var lines []string
+			stderr := captureStderr(t, func() { lines, _ = f.scan(t) })
+			slices.Sort(lines)
+			if !slices.Equal(lines, tt.want) {
+				t.Errorf("lines = %q, want %q", lines, tt.want)
+			}
+			if tt.malformed == "" && strings.Contains(stderr, "malformed") {
+				t.Errorf("unexpected warning: %s", stderr)
+			}
+			if !strings.Contains(stderr, tt.malformed) {
+				t.Errorf("stderr = %q, want it to report %q", stderr, tt.malformed)
+			}
+		})
+	}
+}
+
+// profileIDs returns the sorted www profile IDs of output lines.
+func profileIDs(lines []string) []string {
+	var ids []string
+	for _, l := range lines {
+		ids = append(ids, strings.TrimPrefix(lineID(l), "www.kogama.com/"))
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+func TestOnlyRecent(t *testing.T) {
+	seen := func(id int, ago time.Duration) map[string]any {
+		e := entry(id, "crap", id)
+		if ago >= 0 {
+			e["last_seen"] = time.Now().Add(-ago).UTC().Format(time.RFC3339)
+		}
+		return e
+	}
+
+	tests := []struct {
+		name    string
+		window  time.Duration
+		undated bool
+		want    []string
+	}{
+		{"off", 0, false, []string{"1", "2", "3"}},
+		{"72h includes undated", 72 * time.Hour, false, []string{"1", "3"}},
+		{"72h excludes undated", 72 * time.Hour, true, []string{"1"}},
+		{"a week", 7 * 24 * time.Hour, true, []string{"1", "2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFixture(t, testFlags)
+			setFlag(t, onlyRecent, tt.window)
+			setFlag(t, skipUndated, tt.undated)
+			f.bucket(t, "1to20000", map[string]any{
+				"a": seen(1, time.Hour),
+				"b": seen(2, 100*time.Hour),
+				"c": seen(3, -1),
+			})
+
+			lines, _ := f.scan(t)
+			if ids := profileIDs(lines); !slices.Equal(ids, tt.want) {
+				t.Fatalf("reported %v, want %v", ids, tt.want)
+			}
+		})
+	}
+}
+
+func TestByRankOrdering(t *testing.T) {
+	f := newFixture(t, testFlags)
+	setFlag(t, byRank, true)
+	f.bucket(t, "20001to40000", map[string]any{
+		"a": entry(1, "crap", 25000),
+		"b": entry(2, "darn", 20001),
+	})
+	f.bucket(t, "1to20000", map[string]any{
+		"c": entry(3, "loser", 7),
+		"d": entry(4, "crap", 0),
+	})
+	f.bucket(t, "imported", map[string]any{"e": entry(5, "darn", 0)})
+	f.scan(t)
+
+	got := readTxt(filepath.Join(f.hits, "inappropriate_accounts.txt"))
+	want := []string{
+		"# 1to20000",
+		"https://www.kogama.com/profile/4/ | crap",
+		"https://www.kogama.com/profile/3/ | loser",
+		"# 20001to40000",
+		"https://www.kogama.com/profile/2/ | darn",
+		"https://www.kogama.com/profile/1/ | crap",
+		"# unranked",
+		"https://www.kogama.com/profile/5/ | darn",
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("-by-rank output =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestMain(m *testing.M) {
+	if args, ok := os.LookupEnv("FORENSICS_MAIN_ARGS"); ok {
+		os.Args = append([]string{"forensics"}, strings.Fields(args)...)
+		main()
+		os.Exit(EXIT_CLEAN)
+	}
+	os.Exit(m.Run())
+}
+
+// runMain runs main with args in the current directory in a child process
+// and returns its exit status and output.
+func runMain(t *testing.T, args string) (int, string, string) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "FORENSICS_MAIN_ARGS="+args)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+	var exit *exec.ExitError
+	if err != nil && !errors.As(err, &exit) {
+		t.Fatal(err)
+	}
+	return cmd.ProcessState.ExitCode(), stdout.String(), stderr.String()
+}
+
+func TestByRankRejectsAppend(t *testing.T) {
+	newFixture(t, testFlags)
+	if code, out, _ := runMain(t, "-by-rank -append"); code != EXIT_ERROR || !strings.Contains(out, "-by-rank cannot be combined with -append") {
+		t.Fatalf("exit %d, output %q", code, out)
+	}
+}
+
+func TestOutputFlagsAreValidatedWithParallelServers(t *testing.T) {
+	tests := []struct {
+		args, want string
+	}{
+		{"-hits-format xml", "-hits-format must be json or ndjson"},
+		{"-verify-rate 0", "-verify-rate must be positive"},
+		{"-debug-patterns", "-debug-patterns needs -hits-format"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.args, func(t *testing.T) {
+			newFixture(t, testFlags)
+			if code, out, _ := runMain(t, "-parallel-servers "+tt.args); code != EXIT_ERROR || !strings.Contains(out, tt.want) {
+				t.Fatalf("exit %d, output %q", code, out)
+			}
+		})
+	}
+}
+
+func TestBOMAndTrailingWhitespace(t *testing.T) {
+	tests := []struct {
+		name         string
+		prefix, tail string
+	}{
+		{"plain", "", ""},
+		{"BOM", "\ufeff", ""},
+		{"trailing whitespace", "", "\n\n  \t\r\n"},
+		{"BOM and trailing whitespace", "\ufeff", " \r\n\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFixture(t, tt.prefix+testFlags+tt.tail)
+			slurs, err := loadSlurs()
+			if err != nil || len(slurs) != 3 {
+				t.Fatalf("loadSlurs = %d terms, %v", len(slurs), err)
+			}
+
+			path := f.bucket(t, "1to20000", map[string]any{"a": entry(1, "crap", 1)})
+			b, _ := os.ReadFile(path)
+			os.WriteFile(path, []byte(tt.prefix+string(b)+tt.tail), 0644)
+			if lines, _ := f.scan(t); len(lines) != 1 {
+				t.Fatalf("scanned %d hits from the data file, want 1", len(lines))
+			}
+		})
+	}
+}
+
+func TestMinFlags(t *testing.T) {
+	tests := []struct {
+		min      int
+		want     []string
+		lowConfs []string
+	}{
+		{1, []string{"1", "2", "3"}, nil},
+		{2, []string{"2", "3"}, []string{"1"}},
+		{3, []string{"3"}, []string{"1", "2"}},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("min=%d", tt.min), func(t *testing.T) {
+			f := newFixture(t, testFlags)
+			setFlag(t, minFlags, tt.min)
+			setFlag(t, lowConf, true)
+			f.bucket(t, "1to20000", map[string]any{
+				"a": entry(1, "crap", 1),
+				"b": entry(2, "crap_loser", 2),
+				"c": entry(3, "crap_darn_loser", 3),
+				"d": entry(4, "clean", 4),
+			})
+			lines, _ := f.scan(t)
+			if ids := profileIDs(lines); !slices.Equal(ids, tt.want) {
+				t.Errorf("reported %v, want %v", ids, tt.want)
+			}
+			low := readTxt(filepath.Join(f.hits, "low_confidence_accounts.txt"))
+			if ids := profileIDs(low); !slices.Equal(ids, tt.lowConfs) {
+				t.Errorf("low confidence %v, want %v", ids, tt.lowConfs)
+			}
+		})
+	}
+}
+
+func TestDetectServer(t *testing.T) {
+	tests := []struct {
+		path   string
+		server string
+		ok     bool
+	}{
+		{"/srv/Data/www/1to20000", "www", true},
+		{"/srv/Data/br/1to20000/data.json", "br", true},
+		{"/srv/Data/friends", "friends", true},
+		{"/srv/Data/BR/20001to40000", "br", true},
+		{"relative/Data/friends/1to20000", "friends", true},
+		{"/srv/exports/1to20000", "", false},
+	}
+	for _, tt := range tests {
+		server, ok := detectServer(filepath.FromSlash(tt.path))
+		if server != tt.server || ok != tt.ok {
+			t.Errorf("detectServer(%q) = %q, %v; want %q, %v", tt.path, server, ok, tt.server, tt.ok)
+		}
+	}
+}
+
+func TestInferredServerPicksTheHost(t *testing.T) {
+	f := newFixture(t, testFlags)
+	f.dataWWW = filepath.Join(f.root, "Data", "br")
+	f.bucket(t, "1to20000", map[string]any{"a": entry(1, "crap", 1)})
+
+	code, out, _ := runMain(t, "-dir Data/br/1to20000")
+	if code != EXIT_CLEAN {
+		t.Fatalf("exit %d: %s", code, out)
+	}
+	var found bool
+	filepath.WalkDir(f.root, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && d.Name() == "inappropriate_accounts.txt" {
+			lines := readTxt(path)
+			found = len(lines) == 1 && strings.HasPrefix(lines[0], "https://www.kogama.com.br/profile/1/")
+		}
+		return nil
+	})
+	if !found {
+		t.Fatal("the hit was not reported with the br host")
+	}
+}
+
+// collections reads every per-slur collection file under hits, keyed by its
+// relative path, with the lines sorted.
+func collections(t *testing.T, hits string) map[string]string {
+	t.Helper()
+	out := make(map[string]string)
+	root := filepath.Join(hits, "inappropriate_accounts_collections")
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, _ := filepath.Rel(root, path)
+		lines := readTxt(path)
+		slices.Sort(lines)
+		out[rel] = strings.Join(lines, "\n") + "\ncount=" + headerCount(t, path)
+		return nil
+	})
+	return out
+}
+
+func TestStreamedCollectionsMatchBuffered(t *testing.T) {
+	f := newFixture(t, testFlags)
+	f.bucket(t, "1to20000", map[string]any{
+		"a": entry(1, "crap", 1),
+		"b": entry(2, "crap_loser", 2),
+		"c": entry(3, "darn", 3),
+	})
+	f.bucket(t, "20001to40000", map[string]any{
+		"d": entry(4, "l0ser", 20001),
+		"e": entry(5, "clean", 20002),
+	})
+
+	f.scan(t)
+	buffered := collections(t, f.hits)
+	os.RemoveAll(f.hits)
+
+	setFlag(t, streamHits, true)
+	f.scan(t)
+	streamed := collections(t, f.hits)
+
+	if len(buffered) != 3 || !maps.Equal(buffered, streamed) {
+		t.Fatalf("streamed collections %v, buffered %v", streamed, buffered)
+	}
+	if entries, _ := filepath.Glob(filepath.Join(f.hits, ".spool-*")); len(entries) != 0 {
+		t.Fatalf("spool left behind: %v", entries)
+	}
+}
+
+func TestRegexCollectionsDoNotCollide(t *testing.T) {
+	for _, stream := range []bool{false, true} {
+		t.Run(fmt.Sprintf("stream=%v", stream), func(t *testing.T) {
+			f := newFixture(t, `{"MISC": [{"regex": "f[u]ck"}, {"regex": "f(u)ck"}]}`)
+			setFlag(t, streamHits, stream)
+			f.bucket(t, "1to20000", map[string]any{"a": entry(1, "fuck", 1)})
+			f.scan(t)
+
+			got := collections(t, f.hits)
+			if len(got) != 2 {
+				t.Fatalf("collections %v, want one file per regex", got)
+			}
+			for _, term := range []string{"f[u]ck", "f(u)ck"} {
+				path := filepath.Join(f.hits, "inappropriate_accounts_collections", "txt", "MISC", "slur_"+termFilename(term)+".txt")
+				if lines := readTxt(path); len(lines) != 1 {
+					t.Errorf("%s: collection holds %v, want its one hit", term, lines)
+				}
+			}
+		})
+	}
+}
+
+func TestHitFieldsArePopulated(t *testing.T) {
+	f := newFixture(t, testFlags)
+	setFlag(t, hitsFormat, "ndjson")
+	emoji := transform(t, "emoji")
+	setFlag(t, &emoji.Enabled, true)
+
+	e := entry(42, "🇨🇷🇦🇵_Lóser", 120, 1, 3)
+	f.bucket(t, "1to20000", map[string]any{"a": e})
+	_, hits := f.scan(t)
+	if len(hits) != 1 {
+		t.Fatalf("got %d hits, want 1", len(hits))
+	}
+
+	want := Hit{
+		ProfileID:  "42",
+		Server:     "www",
+		URL:        "https://www.kogama.com/profile/42/",
+		Username:   "🇨🇷🇦🇵_Lóser",
+		Normalized: "crap_loser",
+		Terms:      []string{"crap", "loser"},
+		Categories: []string{"INSULTS", "PROFANITY"},
+		Rank:       120,
+		Pages:      []int{1, 3},
+		ScannedAt:  hits[0].ScannedAt,
+	}
+	if got, _ := json.Marshal(hits[0]); string(got) != string(must(json.Marshal(want))) {
+		t.Errorf("hit = %s\nwant  %s", got, must(json.Marshal(want)))
+	}
+	if _, err := time.Parse(time.RFC3339, hits[0].ScannedAt); err != nil {
+		t.Errorf("scanned_at = %q: %v", hits[0].ScannedAt, err)
+	}
+
+	b, err := os.ReadFile(filepath.Join(f.hits, "hits.ndjson"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var written Hit
+	if err := json.Unmarshal(bytes.TrimSpace(b), &written); err != nil || written.Normalized != "crap_loser" {
+		t.Errorf("hits.ndjson = %s (%v)", b, err)
+	}
+}
+
+func must[T any](v T, err error) T {
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+func TestRankRange(t *testing.T) {
+	unranked := entry(5, "crap", 0)
+	delete(unranked["latest"].(map[string]any), "rank")
+
+	tests := []struct {
+		min, max int
+		want     []string
+	}{
+		{0, 0, []string{"1", "2", "3", "5"}},
+		{0, 1000, []string{"1", "2"}},
+		{500, 1000, []string{"2"}},
+		{1001, 0, []string{"3"}},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d-%d", tt.min, tt.max), func(t *testing.T) {
+			f := newFixture(t, testFlags)
+			setFlag(t, minRank, tt.min)
+			setFlag(t, maxRank, tt.max)
+			f.bucket(t, "1to20000", map[string]any{
+				"a": entry(1, "crap", 1),
+				"b": entry(2, "crap", 1000),
+				"c": entry(3, "crap", 1001),
+			})
+			f.bucket(t, "imported", map[string]any{"e": unranked})
+			lines, _ := f.scan(t)
+			if ids := profileIDs(lines); !slices.Equal(ids, tt.want) {
+				t.Fatalf("reported %v, want %v", ids, tt.want)
+			}
+		})
+	}
+}
+
+func gzipped(t *testing.T, s string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(s))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestGzippedFlags(t *testing.T) {
+	newFixture(t, testFlags)
+	plain, err := loadSlurs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		setup   func()
+		wantErr string
+	}{
+		{"gzip magic in flags.json", func() {
+			os.WriteFile(SLURS_JSON, gzipped(t, testFlags), 0644)
+		}, ""},
+		{"flags.json.gz", func() {
+			os.Remove(SLURS_JSON)
+			os.WriteFile(SLURS_JSON+".gz", gzipped(t, testFlags), 0644)
+		}, ""},
+		{"truncated gzip", func() {
+			os.Remove(SLURS_JSON + ".gz")
+			b := gzipped(t, testFlags)
+			os.WriteFile(SLURS_JSON, b[:len(b)/2], 0644)
+		}, "decompress"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.setup()
+			got, err := loadSlurs()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("loadSlurs error = %v, want it to mention %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || !maps.Equal(got, plain) {
+				t.Fatalf("loadSlurs = %v, %v; want %v", got, err, plain)
+			}
+		})
+	}
+}
+
+func TestCompatFold(t *testing.T) {
+	f := newFixture(t, testFlags)
+	patterns := f.patterns(t)
+
+	styled := []string{"Ｃｒａｐ", "ｌｏｓｅｒ", "𝗰𝗿𝗮𝗽", "𝓵𝓸𝓼𝓮𝓻", "𝔡𝔞𝔯𝔫", "𝚌𝚛𝚊𝚙"}
+	for _, name := range styled {
+		if len(detect(name, patterns)) != 0 {
+			t.Errorf("detect(%q) matched without -compat-fold", name)
+		}
+	}
+
+	setFlag(t, compatFold, true)
+	for _, name := range styled {
+		if len(detect(name, patterns)) != 1 {
+			t.Errorf("detect(%q) missed the styled spelling with -compat-fold", name)
+		}
+	}
+	if got := asciiFold("Ｃｒａｐ 𝗰𝗿𝗮𝗽"); got != "crap crap" {
+		t.Errorf("asciiFold = %q, want crap crap", got)
+	}
+}
+
+func TestDiffReportsNewlyFlagged(t *testing.T) {
+	f := newFixture(t, testFlags)
+	prev := &fixture{dataWWW: filepath.Join(f.root, "previous", "www")}
+	prev.bucket(t, "1to20000", map[string]any{
+		"a": entry(1, "crap", 1),
+		"b": entry(2, "bob", 2),
+		"d": entry(4, "darn", 4),
+	})
+	f.bucket(t, "1to20000", map[string]any{
+		"a": entry(1, "crap", 1),
+		"b": entry(2, "loser", 2),
+		"c": entry(3, "darn", 3),
+	})
+	setFlag(t, diffRoot, prev.dataWWW)
+
+	lines, _ := f.scan(t)
+	if ids := profileIDs(lines); !slices.Equal(ids, []string{"1", "2", "3"}) {
+		t.Errorf("aggregate %v, want every current hit", ids)
+	}
+	fresh := readTxt(filepath.Join(f.hits, "new_hits.txt"))
+	if ids := profileIDs(fresh); !slices.Equal(ids, []string{"2", "3"}) {
+		t.Fatalf("new_hits.txt %v, want the renamed and the new account", ids)
+	}
+}
+
+func TestScanServers(t *testing.T) {
+	f := newFixture(t, testFlags)
+	dataRoot := filepath.Join(f.root, "Data")
+	www := &fixture{dataWWW: filepath.Join(dataRoot, "www")}
+	br := &fixture{dataWWW: filepath.Join(dataRoot, "br")}
+	www.bucket(t, "1to20000", map[string]any{
+		"a": entry(1, "crap", 1),
+		"b": entry(2, "clean", 2),
+	})
+	br.bucket(t, "1to20000", map[string]any{
+		"a": entry(1, "loser", 1),
+		"c": entry(3, "darn", 3),
+	})
+
+	total := scanServers(dataRoot, f.patterns(t), parseFields(*fieldSpec))
+	if total != 3 {
+		t.Errorf("total = %d, want 3", total)
+	}
+
+	hits := filepath.Join(dataRoot, "Hits")
+	if got := readTxt(filepath.Join(hits, "inappropriate_accounts.txt")); len(got) != 1 {
+		t.Errorf("www aggregate = %q", got)
+	}
+	if got := readTxt(filepath.Join(hits, "br", "inappropriate_accounts.txt")); len(got) != 2 {
+		t.Errorf("br aggregate = %q", got)
+	}
+	merged := readTxt(filepath.Join(hits, "all_servers_accounts.txt"))
+	want := []string{
+		"https://www.kogama.com.br/profile/1/ | loser",
+		"https://www.kogama.com.br/profile/3/ | darn",
+		"https://www.kogama.com/profile/1/ | crap",
+	}
+	slices.Sort(merged)
+	if !slices.Equal(merged, want) {
+		t.Fatalf("merged = %q, want %q", merged, want)
+	}
+	if n := headerCount(t, filepath.Join(hits, "all_servers_accounts.txt")); n != "3" {
+		t.Fatalf("merged header count = %s, want 3", n)
+	}
+}
+
+func TestPreviewNormalization(t *testing.T) {
+	newFixture(t, testFlags)
+	setFlag(t, compatFold, true)
+
+	in := "C\u200br\u200ba\u200bp\r\n\nＬ０ｓｅｒ\nl.o.o.s.e.r\n"
+	var out strings.Builder
+	previewNormalization(strings.NewReader(in), &out)
+
+	want := strings.Join([]string{
+		"C\u200br\u200ba\u200bp",
+		`  folded:     "crap"`,
+		`  candidates: "C\u200br\u200ba\u200bp" "crap" "Crap"`,
+		"Ｌ０ｓｅｒ",
+		`  folded:     "l0ser"`,
+		`  candidates: "Ｌ０ｓｅｒ" "l0ser"`,
+		"l.o.o.s.e.r",
+		`  folded:     "l.o.o.s.e.r"`,
+		`  candidates: "l.o.o.s.e.r" "looser"`,
+	}, "\n") + "\n"
+	if out.String() != want {
+		t.Fatalf("preview =\n%s\nwant\n%s", out.String(), want)
+	}
+}
+
+func TestSummaryCountsAndExamples(t *testing.T) {
+	f := newFixture(t, testFlags)
+	setFlag(t, summaryOut, true)
+	f.bucket(t, "1to20000", map[string]any{
+		"a": entry(1, "crap", 1),
+		"b": entry(2, "cr4p_loser", 2),
+		"c": entry(3, "CRAP_99", 3),
+		"d": entry(4, "l0ser", 4),
+		"e": entry(5, "darn", 5),
+		"f": entry(6, "clean", 6),
+	})
+	f.scan(t)
+
+	b, err := os.ReadFile(filepath.Join(f.hits, "summary.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var summary RunSummary
+	if err := json.Unmarshal(b, &summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary.Total != 5 {
+		t.Errorf("total = %d, want 5", summary.Total)
+	}
+
+	want := []struct {
+		term     string
+		count    int
+		examples []string
+	}{
+		{"crap", 3, []string{"crap", "cr4p_loser", "CRAP_99"}},
+		{"loser", 2, []string{"cr4p_loser", "l0ser"}},
+		{"darn", 1, []string{"darn"}},
+	}
+	if len(summary.Terms) != len(want) {
+		t.Fatalf("terms = %+v", summary.Terms)
+	}
+	for i, w := range want {
+		got := summary.Terms[i]
+		if got.Term != w.term || got.Count != w.count || !slices.Contains(w.examples, got.Example) {
+			t.Errorf("terms[%d] = %+v, want %s with count %d and an example from %v", i, got, w.term, w.count, w.examples)
+		}
+	}
+}
+
+func TestRelativeReportedPaths(t *testing.T) {
+	tests := []struct {
+		args     string
+		absolute bool
+	}{
+		{"", true},
+		{"-relative-paths", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.args, func(t *testing.T) {
+			f := newFixture(t, testFlags)
+			f.bucket(t, "1to20000", map[string]any{"a": entry(1, "crap", 1)})
+
+			code, out, _ := runMain(t, tt.args)
+			if code != EXIT_CLEAN {
+				t.Fatalf("exit %d: %s", code, out)
+			}
+			if got := strings.Contains(out, f.root); got != tt.absolute {
+				t.Errorf("output mentions %s: %v, want %v\n%s", f.root, got, tt.absolute, out)
+			}
+			if !tt.absolute && !strings.Contains(out, "TXT hits written to Hits") {
+				t.Errorf("output does not report the relative Hits path:\n%s", out)
+			}
+			if len(readTxt(filepath.Join(f.hits, "inappropriate_accounts.txt"))) != 1 {
+				t.Error("the hits were not written to data/Hits")
+			}
+		})
+	}
+}
+
+func TestDebugPatterns(t *testing.T) {
+	for _, on := range []bool{false, true} {
+		t.Run(fmt.Sprint(on), func(t *testing.T) {
+			f := newFixture(t, testFlags)
+			setFlag(t, hitsFormat, "json")
+			setFlag(t, debugPats, on)
+			f.bucket(t, "1to20000", map[string]any{"a": entry(1, "cr4p_l0s3r", 1)})
+			patterns := f.patterns(t)
+			_, hits := f.scan(t)
+			if len(hits) != 1 {
+				t.Fatalf("got %d hits, want 1", len(hits))
+			}
+			h := hits[0]
+
+			if !on {
+				if h.Patterns != nil {
+					t.Fatalf("patterns %q recorded without -debug-patterns", h.Patterns)
+				}
+				return
+			}
+			if len(h.Patterns) != len(h.Terms) {
+				t.Fatalf("terms %v, patterns %q", h.Terms, h.Patterns)
+			}
+			for i, term := range h.Terms {
+				if h.Patterns[i] != patterns[term].Re.String() {
+					t.Errorf("pattern for %s = %q, want %q", term, h.Patterns[i], patterns[term].Re.String())
+				}
+				if !regexp.MustCompile(h.Patterns[i]).MatchString("cr4p_l0s3r") {
+					t.Errorf("pattern for %s does not reproduce the match", term)
+				}
+			}
+			for _, l := range readTxt(filepath.Join(f.hits, "inappropriate_accounts.txt")) {
+				if strings.Contains(l, h.Patterns[0]) {
+					t.Error("the pattern leaked into the txt output")
+				}
+			}
+		})
+	}
+}
+
+func TestWarmupReportsCompileTime(t *testing.T) {
+	setFlag(t, quiet, false)
+	setFlag(t, threads, 3)
+	stderr := captureStderr(t, func() { compilePatterns(syntheticFlags(20)) })
+	if !regexp.MustCompile(`^compiled 20 patterns in \S+ with 3 threads\n$`).MatchString(stderr) {
+		t.Fatalf("warmup report = %q", stderr)
+	}
+}
+
+// BenchmarkWarmup times the full warmup, including the loose near-miss
+// patterns, on a flag list mixing leet-expanded terms and raw regexes.
+func BenchmarkWarmup(b *testing.B) {
+	setFlag(b, quiet, true)
+	setFlag(b, nearMiss, true)
+	slurs := syntheticFlags(3000)
+	for i := 0; i < 200; i++ {
+		slurs[fmt.Sprintf("raw%d[a-z]{2,4}x", i)] = Flag{Raw: true, Category: "RAW"}
+	}
+
+	setFlag(b, threads, 1)
+	want := patternStrings(compilePatterns(slurs))
+
+	for _, n := range []int{1, max(4, runtime.NumCPU())} {
+		b.Run(fmt.Sprintf("threads=%d", n), func(b *testing.B) {
+			*threads = n
+			if got := patternStrings(compilePatterns(slurs)); !maps.Equal(got, want) {
+				b.Fatalf("threads=%d produced a different pattern map", n)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				compilePatterns(slurs)
+			}
+		})
+	}
+}
+
+func TestKeyboardAdjacency(t *testing.T) {
+	f := newFixture(t, `{"MISC": ["loser", "crap", "fag"]}`)
+
+	tests := []struct {
+		username string
+		want     bool
+	}{
+		{"loser", true},
+		{"lpser", true},  // o→p
+		{"loswr", true},  // e→w
+		{"l0sef", true},  // leet plus one swap
+		{"lpswr", false}, // two swaps
+		{"vrap", true},   // c→v
+		{"vtsp", false},  // every letter swapped
+		{"fah", false},   // terms under four letters never swap
+	}
+
+	off := f.patterns(t)
+	for _, name := range []string{"lpser", "loswr", "vrap"} {
+		if len(detect(name, off)) != 0 {
+			t.Errorf("detect(%q) matched with -keyboard-adjacent off", name)
+		}
+	}
+
+	setFlag(t, adjacentKeys, true)
+	on := f.patterns(t)
+	for _, tt := range tests {
+		if got := len(detect(tt.username, on)) > 0; got != tt.want {
+			t.Errorf("detect(%q) = %v, want %v", tt.username, got, tt.want)
+		}
+	}
+}
+
+func TestFlaggedWithoutID(t *testing.T) {
+	f := newFixture(t, testFlags)
+	setFlag(t, summaryOut, true)
+	noID := entry(nil, "crap", 1)
+	emptyID := entry("", "loser", 2)
+	f.bucket(t, "1to20000", map[string]any{
+		"a": entry(1, "darn", 3),
+		"b": noID,
+		"c": emptyID,
+		"d": entry(nil, "clean", 4),
+	})
+	lines, _ := f.scan(t)
+	if len(lines) != 1 {
+		t.Errorf("aggregate = %q, want only the account with an ID", lines)
+	}
+
+	got := readTxt(filepath.Join(f.hits, "flagged_no_id.txt"))
+	if len(got) != 2 || !strings.Contains(strings.Join(got, "\n"), "crap") || !strings.Contains(strings.Join(got, "\n"), "loser") {
+		t.Fatalf("flagged_no_id.txt = %q, want both flagged accounts without an ID", got)
+	}
+	for _, l := range got {
+		if !strings.Contains(l, "1to20000") {
+			t.Errorf("%q does not say which bucket the account came from", l)
+		}
+	}
+
+	var summary RunSummary
+	b, _ := os.ReadFile(filepath.Join(f.hits, "summary.json"))
+	if err := json.Unmarshal(b, &summary); err != nil || summary.NoID != 2 {
+		t.Fatalf("summary flagged_no_id = %d (%v), want 2", summary.NoID, err)
+	}
+}
+
+func TestCheckURLs(t *testing.T) {
+	var nonHead atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead {
+			nonHead.Add(1)
+		}
+		switch r.URL.Path {
+		case "/profile/2/":
+			w.WriteHeader(http.StatusNotFound)
+		case "/profile/3/":
+			w.WriteHeader(http.StatusGone)
+		case "/profile/4/":
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer srv.Close()
+
+	var lines []string
+	for id := 1; id <= 4; id++ {
+		lines = append(lines, joinFields(fmt.Sprintf("%s/profile/%d/", srv.URL, id), fmt.Sprintf("user%d", id)))
+	}
+	got := checkURLs(srv.Client(), lines, 1000)
+
+	want := []string{"live", "gone", "gone", "unknown (status 403)"}
+	for i, w := range want {
+		if got[i] != joinFields(lines[i], w) {
+			t.Errorf("line %d = %q, want it annotated %q", i, got[i], w)
+		}
+	}
+	if n := nonHead.Load(); n > 0 {
+		t.Errorf("%d requests were not HEAD", n)
+	}
+}
+
+func TestPagesHistogram(t *testing.T) {
+	f := newFixture(t, testFlags)
+	setFlag(t, summaryOut, true)
+	many := make([]int, 12)
+	for i := range many {
+		many[i] = i + 1
+	}
+	f.bucket(t, "1to20000", map[string]any{
+		"a": entry(1, "crap", 1, 1),
+		"b": entry(2, "darn", 2, 1, 2),
+		"c": entry(3, "loser", 3, many...),
+		"d": entry(4, "clean", 4, 1),
+		"e": entry(5, "clean", 5, 1, 2, 3, 4),
+		"f": entry(6, "nopages", 6),
+	})
+	f.scan(t)
+
+	var summary RunSummary
+	b, _ := os.ReadFile(filepath.Join(f.hits, "summary.json"))
+	if err := json.Unmarshal(b, &summary); err != nil {
+		t.Fatal(err)
+	}
+	wantFlagged := map[string]int{"1": 1, "2": 1, "11+": 1}
+	wantAll := map[string]int{"1": 2, "2": 1, "4-5": 1, "11+": 1}
+	for _, bucket := range PAGE_HISTOGRAM {
+		if got := summary.PagesFlagged[bucket.Label]; got != wantFlagged[bucket.Label] {
+			t.Errorf("flagged accounts on %s pages = %d, want %d", bucket.Label, got, wantFlagged[bucket.Label])
+		}
+		if got := summary.PagesAll[bucket.Label]; got != wantAll[bucket.Label] {
+			t.Errorf("accounts on %s pages = %d, want %d", bucket.Label, got, wantAll[bucket.Label])
+		}
+	}
+}
+
+func TestLongUsernamesAreTruncatedOnlyInTxt(t *testing.T) {
+	f := newFixture(t, testFlags)
+	setFlag(t, maxNameLen, 10)
+	setFlag(t, hitsFormat, "json")
+	long := strings.Repeat("x", 150) + "_crap_" + strings.Repeat("é", 150)
+	f.bucket(t, "1to20000", map[string]any{"a": entry(1, long, 1)})
+
+	lines, hits := f.scan(t)
+	if want := "https://www.kogama.com/profile/1/ | xxxxxxxxxx…"; len(lines) != 1 || lines[0] != want {
+		t.Fatalf("txt lines = %q, want %q", lines, want)
+	}
+	collection := readTxt(filepath.Join(f.hits, "inappropriate_accounts_collections", "txt", "PROFANITY", "slur_crap.txt"))
+	if len(collection) != 1 || collection[0] != lines[0] {
+		t.Errorf("collection = %q, want the truncated line", collection)
+	}
+
+	var written []Hit
+	b, _ := os.ReadFile(filepath.Join(f.hits, "hits.json"))
+	if err := json.Unmarshal(b, &written); err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 1 || hits[0].Username != long || len(written) != 1 || written[0].Username != long {
+		t.Fatal("the JSON record does not keep the full username")
+	}
+}
+
+// resumeOutputs collects what an interrupted-then-resumed scan must
+// reproduce: the hits, the near misses and every total, minus timestamps.
+func resumeOutputs(t *testing.T, f *fixture) map[string]string {
+	t.Helper()
+	out := make(map[string]string)
+	for _, name := range []string{"inappropriate_accounts.txt", "near_misses.txt"} {
+		lines := readTxt(filepath.Join(f.hits, name))
+		slices.Sort(lines)
+		out[name] = strings.Join(lines, "\n")
+	}
+	for name, path := range map[string]string{
+		"summary": filepath.Join(f.hits, "summary.json"),
+		"report":  "report.json",
+	} {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var m map[string]any
+		if err := json.Unmarshal(b, &m); err != nil {
+			t.Fatal(err)
+		}
+		delete(m, "scanned_at")
+		if fs, ok := m["forensics"].(map[string]any); ok {
+			delete(fs, "started_at")
+			delete(fs, "duration_seconds")
+		}
+		out[name] = string(must(json.Marshal(m)))
+	}
+	return out
+}
+
+func TestInterruptedScanResumesToTheSameTotals(t *testing.T) {
+	f := newFixture(t, testFlags)
+	const args = "-resume -near-miss -summary -run-report report.json"
+	f.bucket(t, "1to20000", map[string]any{
+		"a": entry(1, "crap", 1, 1),
+		"b": entry(2, "scrapper", 2, 1, 2),
+		"c": entry(3, "clean", 3, 1, 2, 3),
+	})
+	f.bucket(t, "20001to40000", map[string]any{
+		"d": entry(4, "loser", 20001, 51),
+		"e": entry(5, "nice", 20002, 51),
+	})
+	last := f.bucket(t, "40001to60000", map[string]any{
+		"f": entry(6, "darn", 40001, 101),
+		"g": entry(7, "fine", 40002, 101, 102),
+	})
+	lastData, _ := os.ReadFile(last)
+
+	if code, out, _ := runMain(t, args); code != EXIT_CLEAN {
+		t.Fatalf("uninterrupted run: exit %d\n%s", code, out)
+	}
+	want := resumeOutputs(t, f)
+	os.RemoveAll(f.hits)
+	os.Remove("report.json")
+
+	// Interrupt the scan while it blocks reading the last bucket, a FIFO
+	// nobody writes to.
+	os.Remove(last)
+	if err := exec.Command("mkfifo", last).Run(); err != nil {
+		t.Skip("no mkfifo:", err)
+	}
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "FORENSICS_MAIN_ARGS="+args)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	ckpt := filepath.Join(f.hits, CHECKPOINT_FILE)
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		b, _ := os.ReadFile(ckpt)
+		if bytes.Count(b, []byte("\n")) == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			cmd.Process.Kill()
+			t.Fatalf("checkpoint never recorded the first two directories: %s", b)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cmd.Process.Kill()
+	cmd.Wait()
+
+	os.Remove(last)
+	os.WriteFile(last, lastData, 0644)
+	code, out, _ := runMain(t, args)
+	if code != EXIT_CLEAN || !strings.Contains(out, "Resuming: 2 bucket directories already done.") {
+		t.Fatalf("resumed run: exit %d\n%s", code, out)
+	}
+	if got := resumeOutputs(t, f); !maps.Equal(got, want) {
+		t.Fatalf("resumed outputs differ from an uninterrupted run:\n got %v\nwant %v", got, want)
+	}
+	if _, err := os.Stat(ckpt); !os.IsNotExist(err) {
+		t.Fatal("the completed scan left its checkpoint behind")
+	}
+}
+
+func TestResumeRejectsNDJSONInput(t *testing.T) {
+	newFixture(t, testFlags)
+	if code, out, _ := runMain(t, "-resume -input-ndjson accounts.ndjson"); code != EXIT_ERROR || !strings.Contains(out, "-resume cannot be combined with -input-ndjson") {
+		t.Fatalf("exit %d, output %q", code, out)
+	}
+}
+
+func TestCountOnlyMatchesFullRun(t *testing.T) {
+	f := newFixture(t, "\ufeff"+testFlags)
+	f.bucket(t, "1to20000", map[string]any{
+		"a": entry(1, "crap", 1),
+		"b": entry(2, "crap_loser", 2),
+		"c": entry(3, "clean", 3),
+	})
+	f.bucket(t, "20001to40000", map[string]any{
+		"d": entry(4, "darn", 20001),
+		"e": entry(5, "l0ser", 20002),
+	})
+	// An undated entry under -only-recent and the server guess from a
+	// path without a server name both warn.
+	os.Rename(filepath.Join(f.root, "data", "www"), filepath.Join(f.root, "data", "scans"))
+	f.dataWWW = filepath.Join(f.root, "data", "scans")
+
+	code, out, _ := runMain(t, "-dir data/scans/1to20000 -only-recent 1h")
+	if code != EXIT_CLEAN {
+		t.Fatalf("full run: exit %d\n%s", code, out)
+	}
+	full := len(readTxt(filepath.Join(f.hits, "inappropriate_accounts.txt")))
+	os.RemoveAll(f.hits)
+
+	code, out, stderr := runMain(t, "-dir data/scans/1to20000 -only-recent 1h -count-only")
+	if code != EXIT_CLEAN {
+		t.Fatalf("-count-only: exit %d\n%s", code, out)
+	}
+	if want := fmt.Sprintf("total=%d\ncategory.INSULTS=1\ncategory.PROFANITY=2\n", full); out != want {
+		t.Fatalf("-count-only stdout = %q, want %q", out, want)
+	}
+	for _, warning := range []string{"Stripped BOM", "could not infer the server", "no last_seen timestamp"} {
+		if !strings.Contains(stderr, warning) {
+			t.Errorf("stderr lacks %q:\n%s", warning, stderr)
+		}
+	}
+	if _, err := os.Stat(f.hits); !os.IsNotExist(err) {
+		t.Error("-count-only wrote files")
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		delivered int
+	}{
+		{"accepted", http.StatusOK, 120},
+		{"rejected", http.StatusBadRequest, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFixture(t, testFlags)
+			entries := map[string]any{}
+			for i := 1; i <= 120; i++ {
+				entries[strconv.Itoa(i)] = entry(i, "crap_"+strconv.Itoa(i), i)
+			}
+			f.bucket(t, "1to20000", entries)
+
+			var batches atomic.Int64
+			ids := make(chan string, 200)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var payload struct{ Hits []Hit }
+				if err := json.NewDecoder(r.Body).Decode(&payload); err != nil || r.Header.Get("Content-Type") != "application/json" {
+					t.Errorf("bad webhook payload: %v", err)
+				}
+				if len(payload.Hits) > WEBHOOK_BATCH {
+					t.Errorf("batch of %d hits, want at most %d", len(payload.Hits), WEBHOOK_BATCH)
+				}
+				batches.Add(1)
+				for _, h := range payload.Hits {
+					ids <- h.ProfileID
+				}
+				w.WriteHeader(tt.status)
+			}))
+			defer srv.Close()
+
+			code, out, _ := runMain(t, "-webhook "+srv.URL)
+			if code != EXIT_CLEAN {
+				t.Fatalf("exit %d: %s", code, out)
+			}
+			if want := fmt.Sprintf("Webhook: delivered %d of 120 hits.", tt.delivered); !strings.Contains(out, want) {
+				t.Errorf("output does not report %q:\n%s", want, out)
+			}
+			if tt.delivered == 0 && !strings.Contains(out, "failed: status 400") {
+				t.Errorf("the failed batches were not logged:\n%s", out)
+			}
+			if n := batches.Load(); n != 3 {
+				t.Errorf("webhook got %d batches, want 3", n)
+			}
+			close(ids)
+			seen := map[string]bool{}
+			for id := range ids {
+				seen[id] = true
+			}
+			if len(seen) != 120 {
+				t.Errorf("webhook saw %d distinct accounts, want 120", len(seen))
+			}
+			if n := len(readTxt(filepath.Join(f.hits, "inappropriate_accounts.txt"))); n != 120 {
+				t.Errorf("inappropriate_accounts.txt has %d hits, want 120", n)
+			}
+		})
+	}
+}
+
+func TestReduplicatedSpellings(t *testing.T) {
+	f := newFixture(t, testFlags)
+	patterns := f.patterns(t)
+	unrepeated := transform(t, "unrepeated")
+
+	tests := []struct {
+		name    string
+		flagged bool
+	}{
+		{"crapcrap", true},
+		{"crappcrapp", true},
+		{"CRAPCRAPCRAP", true},
+		{"darndarn_99", true},
+		{"l0serl0ser", true},
+		{"crapcrab", false},
+		{"scrapscrap", false},
+		{"bookbook", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := len(detect(tt.name, patterns)) > 0; got != tt.flagged {
+				t.Fatalf("detect(%q) flagged = %v, want %v", tt.name, got, tt.flagged)
+			}
+			if !tt.flagged {
+				return
+			}
+			setFlag(t, &unrepeated.Enabled, false)
+			if len(detect(tt.name, patterns)) > 0 {
+				t.Fatalf("detect(%q) matches without the unrepeated candidate", tt.name)
+			}
+		})
+	}
+	if got := unrepeated.Fn("faggfagg"); got != "fagg fag" {
+		t.Errorf("unrepeated(faggfagg) = %q, want the unit and its squeezed form", got)
+	}
+}
+
+func TestCustomDataFilename(t *testing.T) {
+	f := newFixture(t, testFlags)
+	f.bucket(t, "1to20000", map[string]any{"a": entry(1, "crap", 1), "b": entry(2, "clean", 2)})
+	setFlag(t, dataName, "data-2024-06.json")
+	f.bucket(t, "1to20000", map[string]any{"c": entry(3, "darn", 3), "d": entry(4, "loser", 4)})
+
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{"data-2024-06.json", []string{"3", "4"}},
+		{"data.json", []string{"1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, dataName, tt.name)
+			lines, _ := f.scan(t)
+			if ids := profileIDs(lines); !slices.Equal(ids, tt.want) {
+				t.Fatalf("scanned %v, want %v", ids, tt.want)
+			}
+		})
+	}
+}
+
+func TestExplainTrace(t *testing.T) {
+	f := newFixture(t, testFlags)
+	patterns := f.patterns(t)
+
+	tests := []struct {
+		username string
+		want     []string
+	}{
+		{"C.R.A.P", []string{
+			`username:   "C.R.A.P"`,
+			`folded:     "c.r.a.p"`,
+			`candidate:  collapsed    "crap"`,
+			`match:      crap`,
+			`no match:   darn`,
+			`no match:   loser`,
+			`result:     1 of 3 terms matched`,
+		}},
+		{"nice_guy", []string{
+			`folded:     "nice_guy"`,
+			`candidate:  unrepeated   "nice_guy"`,
+			`no match:   crap`,
+			`result:     0 of 3 terms matched`,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.username, func(t *testing.T) {
+			var out strings.Builder
+			explain(&out, tt.username, patterns)
+			for _, line := range tt.want {
+				if !strings.Contains(out.String(), line) {
+					t.Errorf("trace is missing %q:\n%s", line, out.String())
+				}
+			}
+		})
+	}
+
+	unrepeated := transform(t, "unrepeated")
+	setFlag(t, &unrepeated.Enabled, false)
+	var out strings.Builder
+	explain(&out, "crap", patterns)
+	if strings.Contains(out.String(), "unrepeated") {
+		t.Errorf("trace lists a disabled candidate:\n%s", out.String())
+	}
+}
+
+func TestTrendRecordsAppend(t *testing.T) {
+	f := newFixture(t, testFlags)
+	runs := []struct {
+		entries map[string]any
+		total   int
+		counts  map[string]int
+	}{
+		{map[string]any{"a": entry(1, "crap", 1), "b": entry(2, "clean", 2)}, 1, map[string]int{"crap": 1}},
+		{map[string]any{"a": entry(1, "crap", 1), "b": entry(2, "darn_loser", 2), "c": entry(3, "crap_99", 3)}, 3, map[string]int{"crap": 2, "darn": 1, "loser": 1}},
+	}
+	for _, run := range runs {
+		f.bucket(t, "1to20000", run.entries)
+		f.scan(t)
+	}
+
+	type record struct {
+		ScannedAt string         `json:"scanned_at"`
+		Total     int            `json:"total"`
+		Counts    map[string]int `json:"counts"`
+	}
+	b, err := os.ReadFile(filepath.Join(f.hits, "slur_trends.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []record
+	for _, line := range strings.Split(strings.TrimSuffix(string(b), "\n"), "\n") {
+		var r record
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatalf("record %q: %v", line, err)
+		}
+		records = append(records, r)
+	}
+	if len(records) != len(runs) {
+		t.Fatalf("%d trend records after %d runs:\n%s", len(records), len(runs), b)
+	}
+	for i, run := range runs {
+		got := records[i]
+		if got.ScannedAt == "" || got.Total != run.total || !maps.Equal(got.Counts, run.counts) {
+			t.Errorf("record %d = %+v, want total %d and counts %v", i, got, run.total, run.counts)
+		}
+	}
+}
+
+func TestLatestKeyShapes(t *testing.T) {
+	nested := map[string]any{"a": entry(1, "crap", 1), "b": entry(2, "clean", 2)}
+	flat := map[string]any{
+		"a": map[string]any{"id": 1, "username": "crap", "rank": 1},
+		"b": map[string]any{"id": 2, "username": "clean", "rank": 2},
+	}
+	custom := map[string]any{
+		"a": map[string]any{"profile": map[string]any{"id": 1, "username": "crap"}},
+		"b": map[string]any{"profile": map[string]any{"id": 2, "username": "clean"}},
+	}
+	tests := []struct {
+		name      string
+		latestKey string
+		entries   map[string]any
+		want      []string
+	}{
+		{"nested", "latest", nested, []string{"1"}},
+		{"flat", "", flat, []string{"1"}},
+		{"custom key", "profile", custom, []string{"1"}},
+		{"flat data read as nested", "latest", flat, nil},
+		{"nested data read as flat", "", nested, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFixture(t, testFlags)
+			setFlag(t, latestKey, tt.latestKey)
+			f.bucket(t, "1to20000", tt.entries)
+			lines, _ := f.scan(t)
+			if ids := profileIDs(lines); !slices.Equal(ids, tt.want) {
+				t.Fatalf("flagged %v, want %v", ids, tt.want)
+			}
+		})
+	}
+}
+
+func TestMasterListMergesServers(t *testing.T) {
+	f := newFixture(t, testFlags)
+	setFlag(t, masterList, true)
+	dataRoot := filepath.Join(f.root, "Data")
+	servers := map[string]map[string]any{
+		"www": {"a": entry(1, "crap", 1), "b": entry(2, "clean", 2), "d": entry(4, "darn", 4)},
+		"br":  {"a": entry(1, "crap_loser", 1), "c": entry(3, "darn", 3)},
+	}
+	for server, entries := range servers {
+		(&fixture{dataWWW: filepath.Join(dataRoot, server)}).bucket(t, "1to20000", entries)
+	}
+	scanServers(dataRoot, f.patterns(t), parseFields(*fieldSpec))
+
+	rows := readTxt(filepath.Join(dataRoot, "Hits", "all_servers_master.txt"))
+	tests := []struct {
+		id   string
+		want string
+	}{
+		{"1", "servers=[br,www] | flags=[crap,loser]"},
+		{"3", "servers=[br] | flags=[darn]"},
+		{"4", "servers=[www] | flags=[darn]"},
+	}
+	if len(rows) != len(tests) {
+		t.Fatalf("master list has %d rows, want one per profile ID:\n%s", len(rows), strings.Join(rows, "\n"))
+	}
+	for _, tt := range tests {
+		i := slices.IndexFunc(rows, func(r string) bool { return strings.HasPrefix(r, tt.id+" | ") })
+		if i < 0 {
+			t.Errorf("no master row for profile %s", tt.id)
+			continue
+		}
+		if !strings.HasSuffix(rows[i], tt.want) {
+			t.Errorf("row %q, want it to end with %q", rows[i], tt.want)
+		}
+	}
+}
+
+func TestCaseSensitive(t *testing.T) {
+	const flags = `{"HANDLES": ["BadHandle", {"regex": "^Evil[A-Z]"}], "PROFANITY": ["crap"]}`
+	tests := []struct {
+		username  string
+		sensitive bool
+		want      []string
+	}{
+		{"BadHandle", false, []string{"badhandle"}},
+		{"badhandle", false, []string{"badhandle"}},
+		{"EvilOne", false, []string{"^Evil[A-Z]"}},
+		{"evilone", false, []string{"^Evil[A-Z]"}},
+		{"CRAP", false, []string{"crap"}},
+		{"BadHandle", true, []string{"BadHandle"}},
+		{"badhandle", true, nil},
+		{"BADHANDLE", true, nil},
+		{"EvilOne", true, []string{"^Evil[A-Z]"}},
+		{"evilone", true, nil},
+		{"Evilone", true, nil},
+		{"crap", true, []string{"crap"}},
+		{"CRAP", true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/sensitive=%v", tt.username, tt.sensitive), func(t *testing.T) {
+			f := newFixture(t, flags)
+			setFlag(t, caseSens, tt.sensitive)
+			var got []string
+			for _, m := range detect(tt.username, f.patterns(t)) {
+				got = append(got, m.Flag)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("detect(%q) = %v, want %v", tt.username, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNearMisses(t *testing.T) {
+	f := newFixture(t, testFlags)
+	setFlag(t, nearMiss, true)
+	f.bucket(t, "1to20000", map[string]any{
+		"a": entry(1, "scrapbook", 1),
+		"b": entry(2, "xDarnx99", 2),
+		"c": entry(3, "crap", 3),
+		"d": entry(4, "clean", 4),
+		"e": entry(5, "closer", 5),
+	})
+	lines, _ := f.scan(t)
+	if ids := profileIDs(lines); !slices.Equal(ids, []string{"3"}) {
+		t.Fatalf("flagged %v, want only the bounded term", ids)
+	}
+
+	misses := readTxt(filepath.Join(f.hits, "near_misses.txt"))
+	tests := []struct {
+		id   string
+		term string
+	}{
+		{"1", "crap"},
+		{"2", "darn"},
+		{"5", "loser"},
+	}
+	if len(misses) != len(tests) {
+		t.Fatalf("near_misses.txt = %q, want %d boundary-failed accounts", misses, len(tests))
+	}
+	for _, tt := range tests {
+		if !slices.ContainsFunc(misses, func(l string) bool {
+			return strings.Contains(l, "/profile/"+tt.id+"/") && strings.HasSuffix(l, "term="+tt.term)
+		}) {
+			t.Errorf("near_misses.txt has no %s row for profile %s: %q", tt.term, tt.id, misses)
+		}
+	}
+}
+
+func TestImplausibleIDs(t *testing.T) {
+	tests := []struct {
+		name  string
+		id    any
+		maxID int64
+		valid bool
+	}{
+		{"ordinary", 12345, 1<<31 - 1, true},
+		{"zero", 0, 1<<31 - 1, false},
+		{"negative", -7, 1<<31 - 1, false},
+		{"implausibly large", int64(1) << 40, 1<<31 - 1, false},
+		{"at the maximum", 1000, 1000, true},
+		{"above a lowered maximum", 1001, 1000, false},
+		{"huge with no upper bound", int64(1) << 40, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFixture(t, testFlags)
+			setFlag(t, maxID, tt.maxID)
+			f.bucket(t, "1to20000", map[string]any{
+				"a": entry(tt.id, "crap", 1),
+				"b": entry(tt.id, "clean", 2),
+			})
+			lines, _ := f.scan(t)
+			bad := readTxt(filepath.Join(f.hits, "flagged_bad_id.txt"))
+
+			id := fmt.Sprint(tt.id)
+			if tt.valid {
+				if ids := profileIDs(lines); !slices.Equal(ids, []string{id}) || len(bad) != 0 {
+					t.Fatalf("flagged %v and quarantined %q, want only profile %s flagged", ids, bad, id)
+				}
+				return
+			}
+			if len(lines) != 0 {
+				t.Fatalf("emitted %q for an implausible ID", lines)
+			}
+			if len(bad) != 1 || !strings.HasSuffix(bad[0], "id="+id) {
+				t.Fatalf("flagged_bad_id.txt = %q, want the flagged account with id=%s", bad, id)
+			}
+		})
+	}
+}
+
+func TestCustomDelimiter(t *testing.T) {
+	for _, delim := range []string{" | ", "\t", ";"} {
+		t.Run(strconv.Quote(delim), func(t *testing.T) {
+			f := newFixture(t, testFlags)
+			setFlag(t, delimiter, delim)
+			f.bucket(t, "1to20000", map[string]any{
+				"a": entry(1, "crap", 1),
+				"b": entry(2, "darn_loser", 2),
+			})
+			f.scan(t)
+
+			for _, name := range []string{"inappropriate_accounts.txt", filepath.Join("inappropriate_accounts_collections", "txt", "PROFANITY", "slur_crap.txt")} {
+				lines := readTxt(filepath.Join(f.hits, name))
+				if len(lines) == 0 {
+					t.Fatalf("%s is empty", name)
+				}
+				for _, l := range lines {
+					url, username, ok := strings.Cut(l, delim)
+					if !ok || !strings.HasPrefix(url, "https://www.kogama.com/profile/") || strings.Contains(username, delim) {
+						t.Errorf("%s line %q is not url%susername", name, l, delim)
+					}
+				}
+			}
+
+			// Appending a second scan still dedupes by profile ID.
+			setFlag(t, appendMode, true)
+			f.scan(t)
+			if n := len(readTxt(filepath.Join(f.hits, "inappropriate_accounts.txt"))); n != 2 {
+				t.Fatalf("after -append the aggregate has %d lines, want 2", n)
+			}
+		})
+	}
+}
+
+// writeArchive packs buckets the way the scraper's -export-archive does:
+// manifest.json first, then one <dir>/data.json per bucket.
+func writeArchive(t *testing.T, path, server string, buckets map[string]map[string]any) {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	add := func(name string, v any) {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(b))}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write(b)
+	}
+
+	m := ArchiveManifest{Server: server, CreatedAt: time.Now().UTC().Format(time.RFC3339), DataFile: *dataName, Buckets: len(buckets)}
+	for _, entries := range buckets {
+		m.Profiles += len(entries)
+	}
+	add(ARCHIVE_MANIFEST, m)
+	for _, dir := range sortedKeys(buckets) {
+		add(dir+"/"+*dataName, buckets[dir])
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestArchiveScanMatchesDirectScan(t *testing.T) {
+	buckets := map[string]map[string]any{
+		"1to20000": {
+			"a": entry(1, "crap", 1),
+			"b": entry(2, "clean", 2),
+			"c": entry(3, "d4rn", 3),
+		},
+		"20001to40000": {
+			"d": entry(4, "loser", 20001),
+			"e": entry(5, "nice", 20002),
+		},
+	}
+	tests := []struct {
+		server  string
+		host    string
+		hitsDir string
+	}{
+		{"www", "https://www.kogama.com/", ""},
+		{"br", "https://www.kogama.com.br/", "br"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.server, func(t *testing.T) {
+			f := newFixture(t, testFlags)
+			f.dataWWW = filepath.Join(f.root, "data", tt.server)
+			for dir, entries := range buckets {
+				f.bucket(t, dir, entries)
+			}
+			_, direct, _ := scan(tt.server, f.dataWWW, "", f.hits, f.patterns(t), parseFields(*fieldSpec))
+
+			archive := filepath.Join(f.root, "export", tt.server+".tar.gz")
+			writeArchive(t, archive, tt.server, buckets)
+			if code, out, _ := runMain(t, "-archive "+archive); code != EXIT_CLEAN {
+				t.Fatalf("archive scan: exit %d\n%s", code, out)
+			}
+			packed := readTxt(filepath.Join(f.root, "export", "Hits", tt.hitsDir, "inappropriate_accounts.txt"))
+
+			slices.Sort(direct)
+			slices.Sort(packed)
+			if len(direct) != 3 || !slices.Equal(direct, packed) {
+				t.Fatalf("archive scan %q, direct scan %q", packed, direct)
+			}
+			for _, l := range packed {
+				if !strings.HasPrefix(l, tt.host) {
+					t.Errorf("%q does not use the manifest's server %s", l, tt.server)
+				}
+			}
+		})
+	}
+}
+
+func TestCandidateCapsSpareRawAndFolded(t *testing.T) {
+	padded := strings.Repeat("x.", 200) + "Crap"
+	tests := []struct {
+		name     string
+		username string
+		cands    int
+		length   int
+		want     []string
+	}{
+		{"no caps", "C.R.A.P", 0, 0, []string{"C.R.A.P", "c.r.a.p", "crap"}},
+		{"count cap keeps raw and folded", "C.R.A.P", 1, 0, []string{"C.R.A.P", "c.r.a.p"}},
+		{"count cap drops later transforms", "C.R.A.P", 3, 0, []string{"C.R.A.P", "c.r.a.p", "crap"}},
+		{"length cap skips long spellings", "C R A P  crap_fan", 0, 10, []string{"C R A P  crap_fan", "c r a p  crap_fan"}},
+		{"length cap keeps short spellings", "C.R.A.P", 0, 4, []string{"C.R.A.P", "c.r.a.p", "crap"}},
+		{"long raw is matched in full", padded, 2, 16, []string{padded, strings.ToLower(padded)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFixture(t, testFlags)
+			setFlag(t, maxCands, tt.cands)
+			setFlag(t, maxCandLen, tt.length)
+			if got := usernameCandidates(tt.username); !slices.Equal(got, tt.want) {
+				t.Fatalf("usernameCandidates(%q) = %q, want %q", tt.username, got, tt.want)
+			}
+			if len(detect(tt.username, f.patterns(t))) == 0 {
+				t.Fatalf("detect(%q) missed the term under the caps", tt.username)
+			}
+		})
+	}
+}
+
+// worstCaseUsername gives every transform something to do over a long
+// name: zero-width characters, separators, decoration and a repeat.
+func worstCaseUsername() string {
+	return "xX_" + strings.Repeat("a\u200b.b-c d_", 100) + "crapcrap" + "_Xx"
+}
+
+func BenchmarkCandidateCaps(b *testing.B) {
+	setFlag(b, quiet, true)
+	setFlag(b, &detectCache, nil)
+	for _, t := range CANDIDATES {
+		setFlag(b, &t.Enabled, true)
+	}
+	patterns := compilePatterns(syntheticFlags(300))
+	name := worstCaseUsername()
+
+	for _, caps := range []struct{ cands, length int }{{0, 0}, {7, 0}, {3, 0}, {7, 256}} {
+		b.Run(fmt.Sprintf("candidates=%d/length=%d", caps.cands, caps.length), func(b *testing.B) {
+			setFlag(b, maxCands, caps.cands)
+			setFlag(b, maxCandLen, caps.length)
+			cands := usernameCandidates(name)
+			if len(cands) < 2 || cands[0] != name || (caps.cands > 0 && len(cands) > caps.cands) {
+				b.Fatalf("%d candidates under the caps", len(cands))
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				detect(name, patterns)
+			}
+		})
+	}
+}
+
+// headerFields returns the "Key: value" lines of a txt output's header.
+func headerFields(t *testing.T, path string) map[string]string {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, _, _ := strings.Cut(strings.TrimPrefix(string(b), "\"\n"), "\"\n")
+	fields := map[string]string{}
+	for _, l := range strings.Split(header, "\n") {
+		if k, v, ok := strings.Cut(l, ": "); ok {
+			fields[k] = strings.TrimSpace(v)
+		}
+	}
+	return fields
+}
+
+func TestProvenanceHeader(t *testing.T) {
+	tests := []struct {
+		name       string
+		author     string
+		provenance bool
+	}{
+		{"default", "Simon", false},
+		{"custom author", "Moderation Team", false},
+		{"provenance", "Simon", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFixture(t, testFlags)
+			setFlag(t, author, tt.author)
+			setFlag(t, provenanceOn, tt.provenance)
+			setFlag(t, &provenance, map[string]Provenance{})
+			f.bucket(t, "1to20000", map[string]any{"a": entry(1, "crap", 1)})
+			f.scan(t)
+
+			sum := fmt.Sprintf("%x", sha256.Sum256([]byte(testFlags)))
+			for _, name := range []string{"inappropriate_accounts.txt", filepath.Join("inappropriate_accounts_collections", "txt", "PROFANITY", "slur_crap.txt")} {
+				h := headerFields(t, filepath.Join(f.hits, name))
+				if h["Author of the Filter"] != tt.author || h["Amount of Flagged Accounts in file"] != "1" {
+					t.Errorf("%s header %v, want author %q and count 1", name, h, tt.author)
+				}
+				if !tt.provenance {
+					if _, ok := h["Server"]; ok {
+						t.Errorf("%s has provenance without -provenance: %v", name, h)
+					}
+					continue
+				}
+				if h["Server"] != "www" || h["Data"] != f.dataWWW || h["Flags sha256"] != sum || !strings.HasPrefix(h["Tool"], "Forensics ") {
+					t.Errorf("%s provenance %v, want server www, data %s and flags %s", name, h, f.dataWWW, sum)
+				}
+			}
+		})
+	}
+}
+
+func TestCategoryTree(t *testing.T) {
+	f := newFixture(t, `{"PROFANITY": ["crap", "darn", "heck"], "INSULTS": ["loser"]}`)
+	setFlag(t, categoryTree, true)
+	f.bucket(t, "1to20000", map[string]any{
+		"a": entry(1, "crap", 1),
+		"b": entry(2, "darn", 2),
+		"c": entry(3, "crap_loser", 3),
+		"d": entry(4, "d4rn", 4),
+		"e": entry(5, "heck", 5),
+		"f": entry(6, "clean", 6),
+	})
+	f.scan(t)
+
+	tree := filepath.Join(f.hits, "by_category")
+	tests := []struct {
+		category string
+		index    []string
+		files    map[string]int
+	}{
+		{"INSULTS", []string{"loser.txt | 1"}, map[string]int{"loser.txt": 1}},
+		{"PROFANITY", []string{"crap.txt | 2", "darn.txt | 2", "heck.txt | 1"}, map[string]int{"crap.txt": 2, "darn.txt": 2, "heck.txt": 1}},
+	}
+	dirs, err := os.ReadDir(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dirs) != len(tests) {
+		t.Fatalf("by_category holds %d entries, want one directory per category", len(dirs))
+	}
+	for _, tt := range tests {
+		t.Run(tt.category, func(t *testing.T) {
+			dir := filepath.Join(tree, tt.category)
+			b, err := os.ReadFile(filepath.Join(dir, "index.txt"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n"); !slices.Equal(got, tt.index) {
+				t.Errorf("index.txt = %q, want %q", got, tt.index)
+			}
+			entries, _ := os.ReadDir(dir)
+			if len(entries) != len(tt.files)+1 {
+				t.Errorf("%s holds %d files, want the index and %d term files", dir, len(entries), len(tt.files))
+			}
+			for name, n := range tt.files {
+				if got := len(readTxt(filepath.Join(dir, name))); got != n {
+					t.Errorf("%s has %d accounts, want %d", name, got, n)
+				}
+			}
+		})
+	}
+
+	if code, out, _ := runMain(t, "-by-category -flat"); code != EXIT_ERROR || !strings.Contains(out, "-flat cannot be combined with -by-category") {
+		t.Fatalf("-by-category -flat: exit %d, output %q", code, out)
+	}
+}
+
+func TestEscalation(t *testing.T) {
+	f := newFixture(t, `{"PROFANITY": ["crap", "darn"], "INSULTS": ["loser"], "SPAM": ["buyfollowers"]}`)
+	f.bucket(t, "1to20000", map[string]any{
+		"a": entry(1, "crap_loser", 1),
+		"b": entry(2, "crap_darn", 2),
+		"c": entry(3, "loser_crap_buyfollowers", 3),
+		"d": entry(4, "darn_loser", 4),
+		"e": entry(5, "loser", 5),
+	})
+	f.scan(t)
+
+	got := readTxt(filepath.Join(f.hits, "escalate.txt"))
+	want := []string{
+		"https://www.kogama.com/profile/3/ | loser_crap_buyfollowers | categories=[INSULTS,PROFANITY,SPAM]",
+		"https://www.kogama.com/profile/1/ | crap_loser | categories=[INSULTS,PROFANITY]",
+		"https://www.kogama.com/profile/4/ | darn_loser | categories=[INSULTS,PROFANITY]",
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("escalate.txt =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestFieldMap(t *testing.T) {
+	f := newFixture(t, testFlags)
+	fm, err := parseFieldMap(" username = name, id=uid,rank=position ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setFlag(t, &fieldMap, fm)
+	setFlag(t, hitsFormat, "json")
+	renamed := func(uid any, name string, position int) map[string]any {
+		latest := map[string]any{"uid": uid, "position": position}
+		if name != "" {
+			latest["name"] = name
+		}
+		return map[string]any{"latest": latest}
+	}
+	f.bucket(t, "1to20000", map[string]any{
+		"a": renamed(1, "crap", 7),
+		"b": renamed(2, "clean", 8),
+		"c": renamed(3, "", 9),
+		"d": entry(4, "darn", 10),
+	})
+
+	lines, hits := f.scan(t)
+	if ids := profileIDs(lines); !slices.Equal(ids, []string{"1", "4"}) {
+		t.Fatalf("flagged %v, want the renamed and the plain hit", ids)
+	}
+	ranks := map[string]int{}
+	for _, h := range hits {
+		ranks[h.ProfileID] = h.Rank
+	}
+	if ranks["1"] != 7 || ranks["4"] != 10 {
+		t.Errorf("ranks %v, want 7 from position and 10 from rank", ranks)
+	}
+
+	for _, spec := range []string{"username", "=name", "username=", "username=name,id"} {
+		if _, err := parseFieldMap(spec); err == nil {
+			t.Errorf("parseFieldMap(%q) accepted a malformed entry", spec)
+		}
+	}
+}
+
+func TestVisibleCandidateKeepsRealBoundaries(t *testing.T) {
+	f := newFixture(t, testFlags)
+	patterns := f.patterns(t)
+	matches := func(s string) bool {
+		for _, p := range patterns {
+			if p.Re.MatchString(s) {
+				return true
+			}
+		}
+		return false
+	}
+	visible, collapsed := transform(t, "visible"), transform(t, "collapsed")
+
+	tests := []struct {
+		username  string
+		visible   string
+		collapsed string
+		flagged   bool
+	}{
+		{"c\u200br\u200ba\u200bp.fan", "crap.fan", "crapfan", true},
+		{"dar\u200bn_it", "darn_it", "darnit", true},
+		{"C\u0301rap_99", "Crap_99", "crap99", true},
+		{"scrap.book", "scrap.book", "scrapbook", false},
+		{"sc.rap", "sc.rap", "scrap", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.username, func(t *testing.T) {
+			folded := foldUsername(tt.username)
+			v := visible.Fn(visible.input(tt.username, folded))
+			c := collapsed.Fn(collapsed.input(tt.username, folded))
+			if v != tt.visible || c != tt.collapsed {
+				t.Fatalf("visible %q, collapsed %q; want %q and %q", v, c, tt.visible, tt.collapsed)
+			}
+			if matches(v) != tt.flagged {
+				t.Errorf("visible candidate %q matched = %v, want %v", v, !tt.flagged, tt.flagged)
+			}
+			if matches(c) {
+				t.Errorf("collapsed candidate %q matched; it joins the words around the term", c)
+			}
+			if got := len(detect(tt.username, patterns)) > 0; got != tt.flagged {
+				t.Errorf("detect(%q) flagged = %v, want %v", tt.username, got, tt.flagged)
+			}
+		})
+	}
+}
+
+func TestMissingData(t *testing.T) {
+	tests := []struct {
+		args    string
+		code    int
+		stdout  string
+		warning string
+	}{
+		{"", EXIT_NO_DATA, "Could not locate data/www", ""},
+		{"-allow-missing", EXIT_CLEAN, "", "Warning: Could not locate data/www; nothing to scan."},
+		{"-parallel-servers", EXIT_NO_DATA, "Could not locate a data directory with server subdirectories", ""},
+		{"-parallel-servers -allow-missing", EXIT_CLEAN, "", "nothing to scan"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.args, func(t *testing.T) {
+			newFixture(t, testFlags)
+			code, out, stderr := runMain(t, tt.args)
+			if code != tt.code {
+				t.Fatalf("exit %d, want %d\nstdout: %s\nstderr: %s", code, tt.code, out, stderr)
+			}
+			if tt.stdout != "" && !strings.Contains(out, tt.stdout) {
+				t.Errorf("stdout %q, want %q", out, tt.stdout)
+			}
+			if tt.warning != "" && !strings.Contains(stderr, tt.warning) {
+				t.Errorf("stderr %q, want the warning %q", stderr, tt.warning)
+			}
+			if _, err := os.Stat("data"); !os.IsNotExist(err) {
+				t.Errorf("a run with nothing to scan created output: %v", err)
+			}
+		})
+	}
+}
+
+func TestMaxEntriesPerBucket(t *testing.T) {
+	tests := []struct {
+		cap     int
+		want    []string
+		warning bool
+	}{
+		{3, []string{"1", "2", "3"}, true},
+		{5, []string{"1", "2", "3", "4", "5"}, false},
+		{0, []string{"1", "2", "3", "4", "5"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.cap), func(t *testing.T) {
+			f := newFixture(t, testFlags)
+			setFlag(t, maxEntries, tt.cap)
+			entries := map[string]any{}
+			for i, key := range []string{"a", "b", "c", "d", "e"} {
+				entries[key] = entry(i+1, "crap_"+key, i+1)
+			}
+			f.bucket(t, "1to20000", entries)
+
+			var lines []string
+			stderr := captureStderr(t, func() { lines, _ = f.scan(t) })
+			if ids := profileIDs(lines); !slices.Equal(ids, tt.want) {
+				t.Errorf("flagged %v, want %v", ids, tt.want)
+			}
+			want := fmt.Sprintf("has 5 entries; scanning only the first %d by key", tt.cap)
+			if got := strings.Contains(stderr, want); got != tt.warning {
+				t.Errorf("stderr %q, want the cap warning: %v", stderr, tt.warning)
+			}
+		})
+	}
+}
+
+func TestRunReportAddsForensicsSection(t *testing.T) {
+	f := newFixture(t, testFlags)
+	f.bucket(t, "1to20000", map[string]any{
+		"a": entry(1, "crap", 1),
+		"b": entry(2, "crap_loser", 2),
+		"c": entry(3, "clean", 3),
+	})
+	// The scraper's half of a pipeline run, with a field this tool does
+	// not know about.
+	scrape := `{"started_at":"2026-10-16T00:00:00Z","pages_fetched":3,"rows_ingested":3,"failures":0,"future_field":true}`
+	if err := os.WriteFile("report.json", []byte(`{"scrape":`+scrape+`}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if code, out, _ := runMain(t, "-run-report report.json"); code != EXIT_CLEAN {
+		t.Fatalf("exit %d\n%s", code, out)
+	}
+	var report struct {
+		Scrape    json.RawMessage `json:"scrape"`
+		Forensics *ForensicsStats `json:"forensics"`
+	}
+	b, err := os.ReadFile("report.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, &report); err != nil {
+		t.Fatal(err)
+	}
+
+	var before, after any
+	json.Unmarshal([]byte(scrape), &before)
+	json.Unmarshal(report.Scrape, &after)
+	if !reflect.DeepEqual(before, after) {
+		t.Errorf("scrape section changed to %s", report.Scrape)
+	}
+	got := report.Forensics
+	if got == nil {
+		t.Fatalf("no forensics section in %s", b)
+	}
+	if got.StartedAt == "" || !slices.Equal(got.Servers, []string{"www"}) || got.Scanned != 3 || got.Flagged != 2 {
+		t.Errorf("forensics section %+v, want www with 3 scanned and 2 flagged", got)
+	}
+	if want := map[string]int{"PROFANITY": 2, "INSULTS": 1}; !maps.Equal(got.ByCategory, want) {
+		t.Errorf("by_category = %v, want %v", got.ByCategory, want)
+	}
+}
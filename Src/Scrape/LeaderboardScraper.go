@@ -1,18 +1,32 @@
 package main
 
 import (
+	"archive/tar"
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"hash/fnv"
 	"io"
+	"io/fs"
 	"net/http"
+	_ "net/http/pprof"
+	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -32,38 +46,356 @@ const (
 	PREFETCH_PAGES = 12
 	BUCKET_SIZE    = 20000
 	SAVE_INTERVAL  = 30 * time.Second
+	DRAIN_TIMEOUT  = 5 * time.Second
+
+	LAST_SEEN_REFRESH = time.Hour
+
+	MAX_SAVE_FAILURES = 3
+	MAX_REQUEUES      = 5
+
+	ARCHIVE_MANIFEST = "manifest.json"
+)
+
+var (
+	serverArg   = flag.String("server", "", "server to scrape: br, www, friends or all (prompts when empty)")
+	rateLimit   = flag.Float64("rate", 0, "maximum requests per second shared by all servers (0 = unlimited)")
+	maxInflight = flag.Int("max-inflight", 0, "maximum concurrent requests shared by all servers (0 = unlimited)")
+	caFile      = flag.String("ca-file", "", "PEM file with additional trusted root certificates")
+	insecure    = flag.Bool("insecure", false, "skip TLS certificate verification (unsafe)")
+	pprofAt     = flag.String("pprof", "", "serve net/http/pprof on this address (e.g. localhost:6060)")
+	retries     = flag.Int("retries", 5, "attempts per request before giving up")
+	retryStatus = flag.String("retry-status", "", "HTTP statuses to retry, e.g. 429,408,5xx,!501 (default 429 and all 5xx)")
+	decodeRetry = flag.Int("decode-retries", 2, "refetch a page this many times when its 200 response is not valid JSON (e.g. truncated)")
+	backoff     = flag.Duration("backoff-base", 800*time.Millisecond, "base delay between attempts; attempt n waits n times this")
+	singleFile  = flag.Bool("single-file", false, "store every profile in one data.json instead of rank buckets (for small servers)")
+	requeueGap  = flag.Duration("requeue-interval", 0, "re-queue pages that failed all retries, but the same page at most once per interval and MAX_REQUEUES times (0 = drop them)")
+	firstSave   = flag.Duration("first-save", 5*time.Second, "save this soon after starting and after a failed save, then every SAVE_INTERVAL (0 = wait for the first interval)")
+	workerGap   = flag.Duration("worker-gap", 0, "minimum pause between successive pages fetched by the same worker, on top of -rate")
+	pageDelay   = flag.Duration("page-delay", 0, "fixed pause between dispatching successive pages")
+	fromRank    = flag.Int("from-rank", 0, "start scraping at the page containing this rank instead of resuming")
+	totalRanks  = flag.Int("total-ranks", 0, "approximate number of ranked players, used to print an ETA with each save (0 = rate only)")
+	toRank      = flag.Int("to-rank", 0, "stop after the page containing this rank")
+	minRows     = flag.Int("min-rows", 0, "retry pages with fewer rows than this unless they are the last page (0 = accept any)")
+	pageStep    = flag.Int("page-step", 1, "advance this many pages at a time, e.g. 10 to sample every 10th page")
+	maxDuration = flag.Duration("max-duration", 0, "stop cleanly after running this long, as on Ctrl+C (0 = no limit)")
+	maxPages    = flag.Int("max-pages", 0, "stop after this many pages (0 = no limit)")
+	dryRun      = flag.Bool("dry-scrape", false, "print the URLs a run would request and exit without fetching or writing")
+	compactJSON = flag.Bool("compact", false, "write data.json and last.json without indentation to save disk space")
+	dataName    = flag.String("data-file", "data.json", "name of the per-bucket data file to write")
+	noStore     = flag.Bool("no-store", false, "with -stdout-ndjson, write neither buckets nor last.json")
+	stdoutRows  = flag.Bool("stdout-ndjson", false, "stream every stored row to stdout as NDJSON; other output moves to stderr")
+	runReport   = flag.String("run-report", "", "merge this run's stats into the scrape section of a run_report.json shared with Forensics")
+	cacheDir    = flag.String("cache-dir", "", "cache raw page responses here so restarts within -cache-ttl skip refetching (off when empty)")
+	exportTo    = flag.String("export-archive", "", "package Data/<server> into this .tar.gz with a manifest.json and exit")
+	selfTest    = flag.Bool("selftest", false, "fetch page 1, check the response has the expected shape and exit")
+	requireName = flag.Bool("require-username", false, "skip rows without a username instead of storing them")
+	maxStore    = flag.Int("max-store-rank", 0, "skip rows ranked beyond this number (0 = store all)")
+	cacheTTL    = flag.Duration("cache-ttl", 10*time.Minute, "how long a cached page response stays valid")
 )
 
+var LATENCY_BOUNDS = [...]time.Duration{
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	200 * time.Millisecond,
+	300 * time.Millisecond,
+	500 * time.Millisecond,
+	750 * time.Millisecond,
+	1 * time.Second,
+	1500 * time.Millisecond,
+	2 * time.Second,
+	3 * time.Second,
+	5 * time.Second,
+	REQUEST_TIMEOUT,
+}
+
+type Histogram struct {
+	mu     sync.Mutex
+	counts [len(LATENCY_BOUNDS) + 1]int64
+	total  int64
+}
+
+func (h *Histogram) Observe(d time.Duration) {
+	i := 0
+	for i < len(LATENCY_BOUNDS) && d > LATENCY_BOUNDS[i] {
+		i++
+	}
+	h.mu.Lock()
+	h.counts[i]++
+	h.total++
+	h.mu.Unlock()
+}
+
+func (h *Histogram) Percentile(p float64) time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.total == 0 {
+		return 0
+	}
+	target := int64(float64(h.total)*p + 0.5)
+	if target < 1 {
+		target = 1
+	}
+	var seen int64
+	for i, c := range h.counts {
+		seen += c
+		if seen >= target && i < len(LATENCY_BOUNDS) {
+			return LATENCY_BOUNDS[i]
+		}
+	}
+	return LATENCY_BOUNDS[len(LATENCY_BOUNDS)-1]
+}
+
+func (h *Histogram) Count() int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.total
+}
+
+type RateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func NewRateLimiter(perSecond float64) *RateLimiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	return &RateLimiter{interval: time.Duration(float64(time.Second) / perSecond)}
+}
+
+func (rl *RateLimiter) Wait() {
+	if rl == nil {
+		return
+	}
+	rl.mu.Lock()
+	now := time.Now()
+	if rl.next.Before(now) {
+		rl.next = now
+	}
+	wait := rl.next.Sub(now)
+	rl.next = rl.next.Add(rl.interval)
+	rl.mu.Unlock()
+	time.Sleep(wait)
+}
+
 type RetryClient struct {
-	Client  *http.Client
-	Retries int
+	Client   *http.Client
+	Retries  int
+	Backoff  time.Duration
+	Limiter  *RateLimiter
+	Inflight chan struct{}
+
+	// RetryOn reports whether a response status is worth another attempt;
+	// nil retries 429 and every 5xx.
+	RetryOn func(status int) bool
+
+	Latency  Histogram
+	retried  atomic.Int64
+	failures atomic.Int64
+
+	statusMu sync.Mutex
+	statuses map[string]*StatusCounts
+}
+
+// StatusCounts tallies throttling and server errors seen from one server,
+// counting every attempt, retried or not.
+type StatusCounts struct {
+	TooMany     int64 `json:"429"`
+	ServerError int64 `json:"5xx"`
+}
+
+func (rc *RetryClient) noteStatus(host string, status int) {
+	if status != 429 && status < 500 {
+		return
+	}
+	server := host
+	for name, base := range HOSTNAMES {
+		if u, err := url.Parse(base); err == nil && u.Host == host {
+			server = name
+		}
+	}
+
+	rc.statusMu.Lock()
+	defer rc.statusMu.Unlock()
+	if rc.statuses == nil {
+		rc.statuses = make(map[string]*StatusCounts)
+	}
+	c := rc.statuses[server]
+	if c == nil {
+		c = &StatusCounts{}
+		rc.statuses[server] = c
+	}
+	if status == 429 {
+		c.TooMany++
+	} else {
+		c.ServerError++
+	}
+}
+
+// Statuses returns a copy of the per-server counts.
+func (rc *RetryClient) Statuses() map[string]StatusCounts {
+	rc.statusMu.Lock()
+	defer rc.statusMu.Unlock()
+	out := make(map[string]StatusCounts, len(rc.statuses))
+	for server, c := range rc.statuses {
+		out[server] = *c
+	}
+	return out
 }
 
 func (rc *RetryClient) Get(url string) (*http.Response, error) {
 	var lastErr error
 	for i := 0; i < rc.Retries; i++ {
+		if i > 0 {
+			rc.retried.Add(1)
+		}
+		rc.Limiter.Wait()
+		if rc.Inflight != nil {
+			rc.Inflight <- struct{}{}
+		}
+		start := time.Now()
 		resp, err := rc.Client.Get(url)
-		if err == nil && resp.StatusCode < 500 && resp.StatusCode != 429 {
+		rc.Latency.Observe(time.Since(start))
+		if rc.Inflight != nil {
+			<-rc.Inflight
+		}
+		if err == nil {
+			rc.noteStatus(resp.Request.URL.Host, resp.StatusCode)
+		}
+		if err == nil && !rc.retryable(resp.StatusCode) {
 			return resp, nil
 		}
 		if resp != nil {
 			resp.Body.Close()
 		}
 		lastErr = err
-		time.Sleep(time.Duration(i+1) * 800 * time.Millisecond)
+		if err == nil {
+			lastErr = fmt.Errorf("status %d", resp.StatusCode)
+		}
+		time.Sleep(time.Duration(i+1) * rc.Backoff)
 	}
+	rc.failures.Add(1)
 	return nil, lastErr
 }
 
-func atomicWrite(path string, obj any) error {
-	dir := filepath.Dir(path)
-	_ = os.MkdirAll(dir, 0755)
+func (rc *RetryClient) retryable(status int) bool {
+	if rc.RetryOn != nil {
+		return rc.RetryOn(status)
+	}
+	return status >= 500 || status == 429
+}
+
+// parseStatusSet turns a -retry-status spec into a RetryOn func. Items are
+// exact codes (408) or classes (5xx); a leading ! excludes them instead.
+func parseStatusSet(spec string) (func(int) bool, error) {
+	type item struct {
+		code, class int
+		exclude     bool
+	}
+	var items []item
+	for _, tok := range strings.Split(spec, ",") {
+		tok = strings.ToLower(strings.TrimSpace(tok))
+		if tok == "" {
+			continue
+		}
+		it := item{}
+		if rest, ok := strings.CutPrefix(tok, "!"); ok {
+			it.exclude, tok = true, rest
+		}
+		if c, ok := strings.CutSuffix(tok, "xx"); ok && len(c) == 1 && c[0] >= '1' && c[0] <= '5' {
+			it.class = int(c[0] - '0')
+		} else if n, err := strconv.Atoi(tok); err == nil && n >= 100 && n <= 599 {
+			it.code = n
+		} else {
+			return nil, fmt.Errorf("invalid -retry-status item %q", tok)
+		}
+		items = append(items, it)
+	}
+
+	return func(status int) bool {
+		retry := false
+		for _, it := range items {
+			if it.code == status || it.class == status/100 {
+				if it.exclude {
+					return false
+				}
+				retry = true
+			}
+		}
+		return retry
+	}, nil
+}
+
+func (rc *RetryClient) Summary() string {
+	line := fmt.Sprintf(
+		"Requests: %d | p50 %v | p90 %v | p99 %v | retries %d | failures %d",
+		rc.Latency.Count(),
+		rc.Latency.Percentile(0.50),
+		rc.Latency.Percentile(0.90),
+		rc.Latency.Percentile(0.99),
+		rc.retried.Load(),
+		rc.failures.Load(),
+	)
+	statuses := rc.Statuses()
+	for _, server := range sortedKeys(statuses) {
+		c := statuses[server]
+		line += fmt.Sprintf(" | %s: 429 x%d, 5xx x%d", server, c.TooMany, c.ServerError)
+	}
+	return line
+}
 
-	var buf bytes.Buffer
-	enc := json.NewEncoder(&buf)
-	enc.SetIndent("", "  ")
+func newTransport() (*http.Transport, error) {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	cfg := &tls.Config{}
+
+	if *caFile != "" {
+		pem, err := os.ReadFile(*caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", *caFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if *insecure {
+		fmt.Println("WARNING: TLS certificate verification is DISABLED (-insecure). Do not use against production hosts.")
+		cfg.InsecureSkipVerify = true
+	}
+
+	tr.TLSClientConfig = cfg
+	return tr, nil
+}
+
+// encodeJSON relies on encoding/json emitting map keys in sorted order, so
+// identical bucket contents always serialize to identical bytes.
+func encodeJSON(w io.Writer, obj any) error {
+	enc := json.NewEncoder(w)
+	if !*compactJSON {
+		enc.SetIndent("", "  ")
+	}
 	enc.SetEscapeHTML(false)
-	if err := enc.Encode(obj); err != nil {
+	return enc.Encode(obj)
+}
+
+func hashJSON(obj any) [sha256.Size]byte {
+	h := sha256.New()
+	var sum [sha256.Size]byte
+	if err := encodeJSON(h, obj); err == nil {
+		copy(sum[:], h.Sum(nil))
+	}
+	return sum
+}
+
+func atomicWrite(path string, obj any) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
 		return err
 	}
 
@@ -72,20 +404,54 @@ func atomicWrite(path string, obj any) error {
 	if err != nil {
 		return err
 	}
-	if _, err := io.Copy(f, &buf); err != nil {
+
+	w := bufio.NewWriter(f)
+	if err := encodeJSON(w, obj); err != nil {
 		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
 		return err
 	}
-	_ = f.Sync()
-	f.Close()
 
 	return os.Rename(tmp, path)
 }
 
-func loadJSON(path string, dst any) {
+func decodeJSON(b []byte, dst any, name string) error {
+	if trimmed, ok := bytes.CutPrefix(b, []byte("\ufeff")); ok {
+		fmt.Printf("Stripped BOM from %s\n", name)
+		b = trimmed
+	}
+	return json.NewDecoder(bytes.NewReader(b)).Decode(dst)
+}
+
+func loadJSON(path string, dst any) error {
 	b, err := os.ReadFile(path)
-	if err == nil {
-		_ = json.Unmarshal(b, dst)
+	if err != nil {
+		return err
+	}
+	if err := decodeJSON(b, dst, path); err != nil {
+		return fmt.Errorf("%s is corrupt: %w", path, err)
+	}
+	return nil
+}
+
+func quarantine(path string, err error) {
+	fmt.Println("Warning:", err)
+	if rerr := os.Rename(path, path+".corrupt"); rerr == nil {
+		fmt.Printf("Moved it to %s.corrupt\n", path)
 	}
 }
 
@@ -99,11 +465,22 @@ func buildURL(base string, page int) string {
 	)
 }
 
+var ID_FIELDS = []string{
+	"id", "profile_id", "user_id", "player_id",
+	"profileId", "playerId", "id_str",
+}
+
+func idField(m map[string]any) (string, bool) {
+	for _, k := range ID_FIELDS {
+		if v, ok := m[k]; ok && v != nil {
+			return k, true
+		}
+	}
+	return "", false
+}
+
 func normalizeID(m map[string]any) string {
-	for _, k := range []string{
-		"id", "profile_id", "user_id", "player_id",
-		"profileId", "playerId", "id_str",
-	} {
+	for _, k := range ID_FIELDS {
 		if v, ok := m[k]; ok && v != nil {
 			return fmt.Sprint(v)
 		}
@@ -112,6 +489,47 @@ func normalizeID(m map[string]any) string {
 	return string(b)
 }
 
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// estimateETA extrapolates the time needed for the remaining pages from
+// the pace of the pages done so far.
+func estimateETA(done, remaining int, elapsed time.Duration) (time.Duration, bool) {
+	if done <= 0 || elapsed <= 0 {
+		return 0, false
+	}
+	return time.Duration(float64(elapsed) / float64(done) * float64(remaining)), true
+}
+
+func progressLine(server string, page, endPage, done int, elapsed time.Duration) string {
+	line := fmt.Sprintf("[%s] page %d, %.1f pages/min", server, page, float64(done)/elapsed.Minutes())
+	if endPage <= 0 {
+		return line
+	}
+	left := 0
+	if page <= endPage {
+		left = (endPage-page) / *pageStep + 1
+	}
+	if eta, ok := estimateETA(done, left, elapsed); ok {
+		line += fmt.Sprintf(", ~%d pages left, ETA %s", left, eta.Round(time.Second))
+	}
+	return line
+}
+
+func pageForRank(rank int) int {
+	return pageOf(rank, COUNT)
+}
+
+func pageOf(rank, perPage int) int {
+	return (rank-1)/perPage + 1
+}
+
 func rankBucket(rank int) (int, int) {
 	if rank <= 0 {
 		return 0, 0
@@ -120,39 +538,161 @@ func rankBucket(rank int) (int, int) {
 	return start, start + BUCKET_SIZE - 1
 }
 
+// clock stamps first_seen and last_seen.
+var clock = time.Now
+
+// hashBucket hashes a bucket's data without last_seen, so re-observing
+// unchanged profiles only rewrites the file once the stored last_seen is
+// LAST_SEEN_REFRESH old.
+func hashBucket(data map[string]any) [sha256.Size]byte {
+	stable := make(map[string]any, len(data))
+	for uid, v := range data {
+		entry, ok := v.(map[string]any)
+		if !ok {
+			stable[uid] = v
+			continue
+		}
+		trimmed := make(map[string]any, len(entry))
+		for k, x := range entry {
+			if k != "last_seen" {
+				trimmed[k] = x
+			}
+		}
+		stable[uid] = trimmed
+	}
+	return hashJSON(stable)
+}
+
+// newestSeen returns the latest last_seen in a bucket's data, or the zero time.
+func newestSeen(data map[string]any) time.Time {
+	var newest time.Time
+	for _, v := range data {
+		entry, _ := v.(map[string]any)
+		s, _ := entry["last_seen"].(string)
+		if t, err := time.Parse(time.RFC3339, s); err == nil && t.After(newest) {
+			newest = t
+		}
+	}
+	return newest
+}
+
 type Bucket struct {
+	mu    sync.Mutex
 	Data  map[string]any
 	Dirty bool
+	Hash  [sha256.Size]byte
+	Seen  time.Time
 }
 
 type BucketManager struct {
-	root  string
-	cache map[[2]int]*Bucket
+	mu     sync.Mutex
+	root   string
+	single bool
+	cache  map[[2]int]*Bucket
+	index  map[string][2]int
+
+	// uidLocks serialize Updates of the same uid across the index change,
+	// the move out of its previous bucket and the store.
+	uidLocks [64]sync.Mutex
 }
 
-func NewBucketManager(root string) *BucketManager {
-	return &BucketManager{
-		root:  root,
-		cache: make(map[[2]int]*Bucket),
+func NewBucketManager(root string, single bool) *BucketManager {
+	bm := &BucketManager{
+		root:   root,
+		single: single,
+		cache:  make(map[[2]int]*Bucket),
+		index:  make(map[string][2]int),
 	}
+	if !single {
+		bm.indexBuckets()
+	}
+	return bm
+}
+
+// indexBuckets records which bucket file already holds each uid, so a
+// profile whose rank moved since an earlier run is moved rather than
+// stored twice. Only the keys are decoded; the buckets load lazily.
+func (bm *BucketManager) indexBuckets() {
+	entries, err := os.ReadDir(bm.root)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		var key [2]int
+		if !e.IsDir() {
+			continue
+		}
+		if _, err := fmt.Sscanf(e.Name(), "%dto%d", &key[0], &key[1]); err != nil || e.Name() != fmt.Sprintf("%dto%d", key[0], key[1]) {
+			continue
+		}
+		b, err := os.ReadFile(bm.path(key))
+		if err != nil {
+			continue
+		}
+		var data map[string]json.RawMessage
+		if json.Unmarshal(bytes.TrimPrefix(b, []byte("\ufeff")), &data) != nil {
+			continue
+		}
+		for uid := range data {
+			if _, ok := bm.index[uid]; !ok {
+				bm.index[uid] = key
+			}
+		}
+	}
+}
+
+func (bm *BucketManager) path(key [2]int) string {
+	if bm.single {
+		return filepath.Join(bm.root, *dataName)
+	}
+	return filepath.Join(bm.root, fmt.Sprintf("%dto%d", key[0], key[1]), *dataName)
 }
 
 func (bm *BucketManager) get(start, end int) *Bucket {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+
 	key := [2]int{start, end}
 	if b, ok := bm.cache[key]; ok {
 		return b
 	}
 
-	path := filepath.Join(bm.root, fmt.Sprintf("%dto%d", start, end), "data.json")
 	data := make(map[string]any)
-	loadJSON(path, &data)
+	if err := loadJSON(bm.path(key), &data); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		quarantine(bm.path(key), err)
+		data = make(map[string]any)
+	}
 
-	b := &Bucket{Data: data}
+	for uid := range data {
+		if _, ok := bm.index[uid]; !ok {
+			bm.index[uid] = key
+		}
+	}
+
+	b := &Bucket{Data: data, Hash: hashBucket(data), Seen: newestSeen(data)}
 	bm.cache[key] = b
 	return b
 }
 
+func (bm *BucketManager) take(key [2]int, uid string) map[string]any {
+	b := bm.get(key[0], key[1])
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	entry, ok := b.Data[uid].(map[string]any)
+	if !ok {
+		return nil
+	}
+	delete(b.Data, uid)
+	b.Dirty = true
+	return entry
+}
+
 func extractPages(v any) []int {
+	if pages, ok := v.([]int); ok {
+		return append([]int(nil), pages...)
+	}
+
 	raw, ok := v.([]any)
 	if !ok {
 		return nil
@@ -174,25 +714,75 @@ func extractPages(v any) []int {
 	return out
 }
 
-func (bm *BucketManager) Update(uid string, latest map[string]any, page int) {
-	rank := 0
-	if v, ok := latest["rank"]; ok {
-		switch t := v.(type) {
-		case float64:
-			rank = int(t)
-		case int:
-			rank = t
-		case string:
-			rank, _ = strconv.Atoi(t)
+func entryRank(latest map[string]any) int {
+	switch t := latest["rank"].(type) {
+	case float64:
+		return int(t)
+	case int:
+		return t
+	case string:
+		rank, _ := strconv.Atoi(t)
+		return rank
+	}
+	return 0
+}
+
+func keepRow(ent map[string]any) bool {
+	if *requireName {
+		if name, _ := ent["username"].(string); strings.TrimSpace(name) == "" {
+			return false
+		}
+	}
+	if *maxStore > 0 {
+		if rank := entryRank(ent); rank <= 0 || rank > *maxStore {
+			return false
 		}
 	}
+	return true
+}
 
-	start, end := rankBucket(rank)
+func (bm *BucketManager) Update(uid string, latest map[string]any, page int) {
+	start, end := rankBucket(entryRank(latest))
+	if bm.single {
+		start, end = 0, 0
+	}
 	b := bm.get(start, end)
 
+	var moved map[string]any
+	if !bm.single {
+		h := fnv.New32a()
+		h.Write([]byte(uid))
+		l := &bm.uidLocks[h.Sum32()%uint32(len(bm.uidLocks))]
+		l.Lock()
+		defer l.Unlock()
+
+		key := [2]int{start, end}
+		bm.mu.Lock()
+		prev, ok := bm.index[uid]
+		bm.index[uid] = key
+		bm.mu.Unlock()
+		if ok && prev != key {
+			moved = bm.take(prev, uid)
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := clock().UTC().Format(time.RFC3339)
+	firstSeen := now
+
+	entry, ok := b.Data[uid].(map[string]any)
+	if !ok && moved != nil {
+		entry, ok = moved, true
+	}
+
 	var pages []int
-	if entry, ok := b.Data[uid].(map[string]any); ok {
+	if ok {
 		pages = extractPages(entry["pages"])
+		if fs, ok := entry["first_seen"].(string); ok && fs != "" {
+			firstSeen = fs
+		}
 	}
 
 	for _, p := range pages {
@@ -201,39 +791,164 @@ func (bm *BucketManager) Update(uid string, latest map[string]any, page int) {
 		}
 	}
 	pages = append(pages, page)
+	sort.Ints(pages)
 
 STORE:
 	b.Data[uid] = map[string]any{
-		"latest": latest,
-		"pages":  pages,
+		"latest":     latest,
+		"pages":      pages,
+		"first_seen": firstSeen,
+		"last_seen":  now,
 	}
 	b.Dirty = true
 }
 
-func (bm *BucketManager) SaveDirty() {
+func (bm *BucketManager) SaveDirty() error {
+	bm.mu.Lock()
+	snapshot := make(map[[2]int]*Bucket, len(bm.cache))
 	for key, b := range bm.cache {
-		if !b.Dirty {
-			continue
+		snapshot[key] = b
+	}
+	bm.mu.Unlock()
+
+	var errs []error
+	for key, b := range snapshot {
+		if err := b.save(bm.path(key)); err != nil {
+			errs = append(errs, err)
 		}
-		path := filepath.Join(
-			bm.root,
-			fmt.Sprintf("%dto%d", key[0], key[1]),
-			"data.json",
-		)
-		_ = atomicWrite(path, b.Data)
-		b.Dirty = false
 	}
+	return errors.Join(errs...)
 }
 
-func fetchPage(client *RetryClient, url string) ([]map[string]any, error) {
+// save leaves the bucket dirty when the write fails so the next save retries it.
+func (b *Bucket) save(path string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.Dirty {
+		return nil
+	}
+
+	sum, seen := hashBucket(b.Data), newestSeen(b.Data)
+	if sum != b.Hash || seen.Sub(b.Seen) >= LAST_SEEN_REFRESH {
+		if err := atomicWrite(path, b.Data); err != nil {
+			return err
+		}
+		b.Hash, b.Seen = sum, seen
+	}
+	b.Dirty = false
+	return nil
+}
+
+type PageCache struct {
+	Dir string
+	TTL time.Duration
+}
+
+func (pc *PageCache) path(server string, page int) string {
+	return filepath.Join(pc.Dir, server, fmt.Sprintf("%d.json", page))
+}
+
+func (pc *PageCache) Load(server string, page int) ([]byte, bool) {
+	path := pc.path(server, page)
+	info, err := os.Stat(path)
+	if err != nil || time.Since(info.ModTime()) > pc.TTL {
+		return nil, false
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	return b, true
+}
+
+func (pc *PageCache) Store(server string, page int, body []byte) {
+	path := pc.path(server, page)
+	_ = os.MkdirAll(filepath.Dir(path), 0755)
+	tmp := path + ".tmp"
+	if os.WriteFile(tmp, body, 0644) == nil {
+		_ = os.Rename(tmp, path)
+	}
+}
+
+func fetchBody(client *RetryClient, url string) ([]byte, error) {
 	resp, err := client.Get(url)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+func fetchPage(client *RetryClient, cache *PageCache, server string, page int) ([]map[string]any, error) {
+	if cache != nil {
+		if body, ok := cache.Load(server, page); ok {
+			if data, err := parsePage(body); err == nil {
+				return data, nil
+			}
+		}
+	}
+
+	// A body that fails to decode is refetched: a truncated transfer
+	// usually decodes on the next try, while a server that keeps sending
+	// the same bad bytes is reported as malformed.
+	var first []byte
+	same := true
+	for attempt := 0; ; attempt++ {
+		body, err := fetchBody(client, buildURL(HOSTNAMES[server], page))
+		if err != nil {
+			return nil, err
+		}
+		data, err := parsePage(body)
+		if err == nil {
+			if cache != nil {
+				cache.Store(server, page, body)
+			}
+			return data, nil
+		}
+
+		if attempt == 0 {
+			first = body
+		} else if !bytes.Equal(body, first) {
+			same = false
+		}
+		if attempt >= *decodeRetry {
+			if same && attempt > 0 {
+				return nil, fmt.Errorf("malformed response, identical on %d fetches: %w", attempt+1, err)
+			}
+			return nil, fmt.Errorf("response did not decode after %d fetches: %w", attempt+1, err)
+		}
+		time.Sleep(client.Backoff * time.Duration(attempt+1))
+	}
+}
+
+func fetchFullPage(client *RetryClient, cache *PageCache, server string, page int) ([]map[string]any, error) {
+	data, err := fetchPage(client, cache, server, page)
+	if err != nil || len(data) == 0 || len(data) >= *minRows {
+		return data, err
+	}
 
+	for attempt := 1; attempt < client.Retries; attempt++ {
+		time.Sleep(client.Backoff * time.Duration(attempt))
+		retry, err := fetchPage(client, nil, server, page)
+		if err == nil && len(retry) > len(data) {
+			data = retry
+		}
+		if len(data) >= *minRows {
+			return data, nil
+		}
+	}
+
+	next, err := fetchPage(client, cache, server, page+1)
+	if err == nil && len(next) == 0 {
+		return data, nil
+	}
+	return nil, fmt.Errorf("only %d rows after retries (want at least %d)", len(data), *minRows)
+}
+
+func parsePage(body []byte) ([]map[string]any, error) {
 	var raw map[string]any
-	if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+	if err := json.Unmarshal(body, &raw); err != nil {
 		return nil, err
 	}
 
@@ -247,14 +962,75 @@ func fetchPage(client *RetryClient, url string) ([]map[string]any, error) {
 	return out, nil
 }
 
-func run(server string) error {
-	outdir := filepath.Join("Data", server)
-	_ = os.MkdirAll(outdir, 0755)
+// RowStream serialises rows from every server's run onto one writer.
+type RowStream struct {
+	mu  sync.Mutex
+	w   *bufio.Writer
+	enc *json.Encoder
+}
 
-	lastPath := filepath.Join(outdir, "last.json")
-	last := map[string]any{"page": 1}
-	loadJSON(lastPath, &last)
+var rowStream *RowStream
+
+func NewRowStream(w io.Writer) *RowStream {
+	bw := bufio.NewWriter(w)
+	return &RowStream{w: bw, enc: json.NewEncoder(bw)}
+}
+
+func (rs *RowStream) Write(server string, rows []map[string]any, uids []string, page int) {
+	if rs == nil {
+		return
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
 
+	for i, ent := range rows {
+		_ = rs.enc.Encode(map[string]any{
+			"server": server,
+			"uid":    uids[i],
+			"page":   page,
+			"latest": ent,
+		})
+	}
+	_ = rs.w.Flush()
+}
+
+func startPprof(ctx context.Context, addr string) {
+	srv := &http.Server{Addr: addr, Handler: http.DefaultServeMux}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			fmt.Println("pprof:", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+	fmt.Println("pprof listening on", addr)
+}
+
+type PageData struct {
+	Page int
+	Rows []map[string]any
+	Err  error
+}
+
+func drain(dataCh <-chan PageData, ingest func(PageData)) {
+	deadline := time.After(DRAIN_TIMEOUT)
+	for {
+		select {
+		case data, ok := <-dataCh:
+			if !ok {
+				return
+			}
+			ingest(data)
+		case <-deadline:
+			fmt.Println("Drain timed out; discarding pages still in flight")
+			return
+		}
+	}
+}
+
+func pageRange(last map[string]any) (int, int) {
 	page := 1
 	if v, ok := last["page"]; ok {
 		switch t := v.(type) {
@@ -265,18 +1041,284 @@ func run(server string) error {
 		}
 	}
 
+	if *fromRank > 0 {
+		page = pageForRank(*fromRank)
+	}
+	stopPage := 0
+	if *toRank > 0 {
+		stopPage = pageForRank(*toRank)
+	}
+	if *maxPages > 0 {
+		limit := page + (*maxPages-1)**pageStep
+		if stopPage == 0 || limit < stopPage {
+			stopPage = limit
+		}
+	}
+	return page, stopPage
+}
+
+func selftest(client *RetryClient, base string) error {
+	body, err := fetchBody(client, buildURL(base, 1))
+	if err != nil {
+		return err
+	}
+
+	var raw map[string]any
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return fmt.Errorf("response is not a JSON object: %v", err)
+	}
+	data, ok := raw["data"].([]any)
+	if !ok {
+		return fmt.Errorf("response has no \"data\" array")
+	}
+	if len(data) == 0 {
+		return fmt.Errorf("\"data\" array is empty")
+	}
+
+	field := ""
+	for i, e := range data {
+		m, ok := e.(map[string]any)
+		if !ok {
+			return fmt.Errorf("row %d is not an object", i)
+		}
+		k, ok := idField(m)
+		if !ok {
+			return fmt.Errorf("row %d has none of the ID fields %v", i, ID_FIELDS)
+		}
+		if field == "" {
+			field = k
+		}
+	}
+
+	fmt.Printf("Self-test passed: %d rows, ID field %q\n", len(data), field)
+	return nil
+}
+
+func dryScrape(server string, page, stopPage int) {
+	for ; page <= stopPage; page += *pageStep {
+		fmt.Println(buildURL(HOSTNAMES[server], page))
+	}
+}
+
+func acquireLock(dir string) (func(), error) {
+	path := filepath.Join(dir, "lock")
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		if errors.Is(err, fs.ErrExist) {
+			owner, _ := os.ReadFile(path)
+			return nil, fmt.Errorf("another scraper is already running on %s (pid %s); remove %s if it is not", dir, strings.TrimSpace(string(owner)), path)
+		}
+		return nil, err
+	}
+	fmt.Fprintf(f, "%d\n", os.Getpid())
+	f.Close()
+	return func() { os.Remove(path) }, nil
+}
+
+// ScrapeStats is the scraper's section of run_report.json, summed over
+// every server scraped in this run.
+type ScrapeStats struct {
+	StartedAt string   `json:"started_at"`
+	Duration  float64  `json:"duration_seconds"`
+	Servers   []string `json:"servers"`
+	Pages     int64    `json:"pages_fetched"`
+	Rows      int64    `json:"rows_ingested"`
+	Requests  int64    `json:"requests"`
+	Retries   int64    `json:"retries"`
+	Failures  int64    `json:"failures"`
+
+	Statuses map[string]StatusCounts `json:"status_counts,omitempty"`
+}
+
+// RunReport keeps the Forensics section as raw JSON so merging ours in
+// does not drop fields this tool does not know about.
+type RunReport struct {
+	Scrape    *ScrapeStats    `json:"scrape,omitempty"`
+	Forensics json.RawMessage `json:"forensics,omitempty"`
+}
+
+var pagesIngested, rowsIngested atomic.Int64
+
+func writeRunReport(path string, servers []string, client *RetryClient, started time.Time) error {
+	var report RunReport
+	if err := loadJSON(path, &report); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		fmt.Println("Warning: replacing unreadable", path)
+		report = RunReport{}
+	}
+	report.Scrape = &ScrapeStats{
+		StartedAt: started.UTC().Format(time.RFC3339),
+		Duration:  time.Since(started).Round(time.Millisecond).Seconds(),
+		Servers:   servers,
+		Pages:     pagesIngested.Load(),
+		Rows:      rowsIngested.Load(),
+		Requests:  client.Latency.Count(),
+		Retries:   client.retried.Load(),
+		Failures:  client.failures.Load(),
+		Statuses:  client.Statuses(),
+	}
+	return atomicWrite(path, report)
+}
+
+type ArchiveManifest struct {
+	Server    string `json:"server"`
+	CreatedAt string `json:"created_at"`
+	DataFile  string `json:"data_file"`
+	Buckets   int    `json:"buckets"`
+	Profiles  int    `json:"profiles"`
+}
+
+// exportArchive writes every bucket file under Data/<server> to a gzipped
+// tar at dest, with manifest.json as the first entry so readers can size
+// their progress before the bucket files arrive.
+func exportArchive(server, dest string) (ArchiveManifest, error) {
+	root := filepath.Join("Data", server)
+	m := ArchiveManifest{
+		Server:    server,
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+		DataFile:  *dataName,
+	}
+
+	var files []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || d.Name() != *dataName {
+			return nil
+		}
+		var data map[string]any
+		if err := loadJSON(path, &data); err != nil {
+			return err
+		}
+		files = append(files, path)
+		m.Buckets++
+		m.Profiles += len(data)
+		return nil
+	})
+	if err != nil {
+		return m, err
+	}
+	if len(files) == 0 {
+		return m, fmt.Errorf("no %s files under %s", *dataName, root)
+	}
+
+	tmp := dest + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return m, err
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+
+	zw := gzip.NewWriter(f)
+	tw := tar.NewWriter(zw)
+	add := func(name string, b []byte) error {
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(b)), ModTime: time.Now()}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := tw.Write(b)
+		return err
+	}
+
+	manifest, _ := json.MarshalIndent(m, "", "  ")
+	if err := add(ARCHIVE_MANIFEST, manifest); err != nil {
+		return m, err
+	}
+	for _, path := range files {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return m, err
+		}
+		rel, _ := filepath.Rel(root, path)
+		if err := add(filepath.ToSlash(rel), b); err != nil {
+			return m, err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return m, err
+	}
+	if err := zw.Close(); err != nil {
+		return m, err
+	}
+	if err := f.Close(); err != nil {
+		return m, err
+	}
+	return m, os.Rename(tmp, dest)
+}
+
+func newClient() (*RetryClient, error) {
+	transport, err := newTransport()
+	if err != nil {
+		return nil, err
+	}
 	client := &RetryClient{
-		Client:  &http.Client{Timeout: REQUEST_TIMEOUT},
-		Retries: 5,
+		Client:  &http.Client{Timeout: REQUEST_TIMEOUT, Transport: transport},
+		Retries: *retries,
+		Backoff: *backoff,
+		Limiter: NewRateLimiter(*rateLimit),
+	}
+	if *maxInflight > 0 {
+		client.Inflight = make(chan struct{}, *maxInflight)
+	}
+	if *retryStatus != "" {
+		if client.RetryOn, err = parseStatusSet(*retryStatus); err != nil {
+			return nil, err
+		}
 	}
+	return client, nil
+}
 
-	buckets := NewBucketManager(outdir)
+func run(ctx context.Context, server string, client *RetryClient) error {
+	outdir := filepath.Join("Data", server)
+	lastPath := filepath.Join(outdir, "last.json")
 
-	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
-	defer stop()
+	if !*dryRun {
+		if err := os.MkdirAll(outdir, 0755); err != nil {
+			return err
+		}
+		release, err := acquireLock(outdir)
+		if err != nil {
+			return err
+		}
+		defer release()
+	}
+
+	last := map[string]any{"page": 1}
+	if err := loadJSON(lastPath, &last); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		quarantine(lastPath, err)
+		fmt.Println("Restarting from page 1; already stored profiles are kept.")
+		last = map[string]any{"page": 1}
+	}
+
+	page, stopPage := pageRange(last)
+
+	if *dryRun {
+		if stopPage == 0 {
+			return fmt.Errorf("-dry-scrape needs -max-pages or -to-rank")
+		}
+		dryScrape(server, page, stopPage)
+		return nil
+	}
+
+	buckets := NewBucketManager(outdir, *singleFile)
+
+	var cache *PageCache
+	if *cacheDir != "" {
+		cache = &PageCache{Dir: *cacheDir, TTL: *cacheTTL}
+	}
 
 	pageCh := make(chan int, PREFETCH_PAGES)
-	dataCh := make(chan []map[string]any, PREFETCH_PAGES)
+	dataCh := make(chan PageData, PREFETCH_PAGES)
+
+	// Cancelling stops workers from starting pages still queued in pageCh;
+	// abandon releases any worker left blocked on a send once run stops
+	// draining dataCh.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	abandon := make(chan struct{})
+	defer close(abandon)
 
 	var wg sync.WaitGroup
 
@@ -284,11 +1326,24 @@ func run(server string) error {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
+			var last time.Time
 			for p := range pageCh {
-				url := buildURL(HOSTNAMES[server], p)
-				data, err := fetchPage(client, url)
-				if err == nil && len(data) > 0 {
-					dataCh <- data
+				if *workerGap > 0 {
+					select {
+					case <-ctx.Done():
+						return
+					case <-time.After(time.Until(last.Add(*workerGap))):
+					}
+					last = time.Now()
+				}
+				if ctx.Err() != nil {
+					return
+				}
+				data, err := fetchFullPage(client, cache, server, p)
+				select {
+				case dataCh <- PageData{Page: p, Rows: data, Err: err}:
+				case <-abandon:
+					return
 				}
 			}
 		}()
@@ -299,47 +1354,342 @@ func run(server string) error {
 		close(dataCh)
 	}()
 
+	skipped := 0
+	ingest := func(data PageData) {
+		var rows []map[string]any
+		var uids []string
+		for _, ent := range data.Rows {
+			if !keepRow(ent) {
+				skipped++
+				continue
+			}
+			delete(ent, "history")
+			uid := normalizeID(ent)
+			if !*noStore {
+				buckets.Update(uid, ent, data.Page)
+			}
+			rows = append(rows, ent)
+			uids = append(uids, uid)
+		}
+		rowStream.Write(server, rows, uids, data.Page)
+		rowsIngested.Add(int64(len(rows)))
+	}
+
 	ticker := time.NewTicker(SAVE_INTERVAL)
 	defer ticker.Stop()
 
+	sendCh := pageCh
+	var delayC <-chan time.Time
+	pagesClosed, exhausted := false, false
+
+	// queuedAt holds when each in-flight or failed page was last handed to
+	// the workers; retry lists failed pages waiting for -requeue-interval
+	// and requeues counts how often each has been re-queued.
+	queuedAt := map[int]time.Time{}
+	requeues := map[int]int{}
+	var retry []int
+
+	// closePages ends the page stream once the last page has been handed
+	// out and no page is still in flight or waiting to be re-queued.
+	closePages := func() {
+		if exhausted && !pagesClosed && len(queuedAt) == 0 {
+			close(pageCh)
+			pagesClosed = true
+		}
+	}
+
+	save := func() error {
+		if *noStore {
+			return nil
+		}
+		return errors.Join(buckets.SaveDirty(), atomicWrite(lastPath, last))
+	}
+
+	finish := func() error {
+		cancel()
+		if !pagesClosed {
+			close(pageCh)
+		}
+		drain(dataCh, func(data PageData) {
+			if data.Err == nil {
+				delete(queuedAt, data.Page)
+			}
+			ingest(data)
+		})
+		if len(retry) > 0 {
+			fmt.Printf("Leaving %d failed pages still waiting to be re-queued to the next run: %v\n", len(retry), retry)
+		}
+		// Pages handed out but never stored, like those still queued when
+		// the run was cancelled, are fetched again on resume.
+		resume := page
+		for p := range queuedAt {
+			resume = min(resume, p)
+		}
+		if resume < page {
+			last["page"] = resume
+		}
+		if skipped > 0 {
+			fmt.Printf("Skipped %d rows by the ingest filter.\n", skipped)
+		}
+		if err := save(); err != nil {
+			return fmt.Errorf("final save failed: %w", err)
+		}
+		return nil
+	}
+
+	saveFailures := 0
+
+	if stopPage > 0 && page > stopPage {
+		exhausted = true
+		closePages()
+	}
+
+	endPage := stopPage
+	if endPage == 0 && *totalRanks > 0 {
+		endPage = pageForRank(*totalRanks)
+	}
+	started, pagesDone := time.Now(), 0
+
+	var firstSaveC <-chan time.Time
+	if *firstSave > 0 {
+		firstSaveC = time.After(*firstSave)
+	}
+
+	// A failed save is retried after -first-save rather than a whole
+	// SAVE_INTERVAL, so a full disk stops the run before it fetches much more.
+	checkpoint := func() error {
+		if err := save(); err != nil {
+			saveFailures++
+			fmt.Printf("Warning: save failed (%d/%d): %v\n", saveFailures, MAX_SAVE_FAILURES, err)
+			if saveFailures >= MAX_SAVE_FAILURES {
+				finish()
+				return fmt.Errorf("stopped after %d failed saves, check free disk space: %w", saveFailures, err)
+			}
+			if *firstSave > 0 {
+				firstSaveC = time.After(*firstSave)
+			}
+			return nil
+		}
+		saveFailures = 0
+		fmt.Println(progressLine(server, page, endPage, pagesDone, time.Since(started)))
+		return nil
+	}
+
 	for {
+		next, requeue := page, false
+		var retryC <-chan time.Time
+		if len(retry) > 0 {
+			if wait := *requeueGap - time.Since(queuedAt[retry[0]]); wait <= 0 {
+				next, requeue = retry[0], true
+			} else {
+				retryC = time.After(wait)
+			}
+		}
+		out := sendCh
+		if exhausted && !requeue {
+			out = nil
+		}
+
 		select {
 		case <-ctx.Done():
-			close(pageCh)
-			buckets.SaveDirty()
-			_ = atomicWrite(lastPath, last)
-			return nil
+			return finish()
 
-		case pageCh <- page:
-			page++
+		case out <- next:
+			queuedAt[next] = time.Now()
+			if requeue {
+				retry = retry[1:]
+				break
+			}
+			page += *pageStep
 			last["page"] = page
+			if stopPage > 0 && page > stopPage {
+				exhausted = true
+			} else if *pageDelay > 0 {
+				sendCh = nil
+				delayC = time.After(*pageDelay)
+			}
+
+		case <-delayC:
+			sendCh = pageCh
+			delayC = nil
+
+		case <-retryC:
 
-		case data := <-dataCh:
-			for _, ent := range data {
-				delete(ent, "history")
-				buckets.Update(normalizeID(ent), ent, page-1)
+		case data, ok := <-dataCh:
+			if !ok {
+				return finish()
+			}
+			if data.Err == nil {
+				delete(queuedAt, data.Page)
+				delete(requeues, data.Page)
+				ingest(data)
+				pagesDone++
+				pagesIngested.Add(1)
+			} else if *requeueGap > 0 && requeues[data.Page] < MAX_REQUEUES {
+				requeues[data.Page]++
+				retry = append(retry, data.Page)
+			} else {
+				delete(queuedAt, data.Page)
+				delete(requeues, data.Page)
+				fmt.Printf("Dropping page %d: %v\n", data.Page, data.Err)
+			}
+			closePages()
+
+		case <-firstSaveC:
+			firstSaveC = nil
+			if err := checkpoint(); err != nil {
+				return err
 			}
 
 		case <-ticker.C:
-			buckets.SaveDirty()
-			_ = atomicWrite(lastPath, last)
+			if err := checkpoint(); err != nil {
+				return err
+			}
 		}
 	}
 }
 
+// usageError rejects invalid flags the way the flag package does: on
+// stderr, with exit status 2.
+func usageError(msg string) {
+	fmt.Fprintln(os.Stderr, msg)
+	os.Exit(2)
+}
+
 func main() {
-	fmt.Print("Enter server [br,www,friends]: ")
-	var s string
-	fmt.Scanln(&s)
+	flag.Parse()
+	started := time.Now()
+
+	if *retries < 1 || *backoff <= 0 {
+		usageError("-retries must be >= 1 and -backoff-base must be > 0")
+	}
+	if *decodeRetry < 0 {
+		usageError("-decode-retries must not be negative")
+	}
+	if *maxPages < 0 || *maxDuration < 0 {
+		usageError("-max-pages and -max-duration must not be negative")
+	}
+	if *minRows < 0 || *minRows > COUNT {
+		usageError(fmt.Sprintf("-min-rows must be between 0 and %d", COUNT))
+	}
+	if *requeueGap < 0 || *workerGap < 0 || *firstSave < 0 {
+		usageError("-requeue-interval, -worker-gap and -first-save must not be negative")
+	}
+	if *pageStep < 1 {
+		usageError("-page-step must be at least 1")
+	}
+	if *dataName == "" || filepath.Base(*dataName) != *dataName {
+		usageError("-data-file must be a plain file name")
+	}
+	if *maxStore < 0 || *totalRanks < 0 {
+		usageError("-max-store-rank and -total-ranks must not be negative")
+	}
+	if *fromRank < 0 || *toRank < 0 || (*fromRank > 0 && *toRank > 0 && *fromRank > *toRank) {
+		usageError("-from-rank and -to-rank must be positive and ordered")
+	}
+
+	if *noStore && !*stdoutRows {
+		usageError("-no-store needs -stdout-ndjson")
+	}
+	if *stdoutRows {
+		rowStream = NewRowStream(os.Stdout)
+		os.Stdout = os.Stderr
+	}
+
+	if *rateLimit < 0 || *maxInflight < 0 {
+		usageError("-rate and -max-inflight must not be negative")
+	}
+
+	s := *serverArg
+	if s == "" {
+		fmt.Print("Enter server [br,www,friends,all]: ")
+		fmt.Scanln(&s)
+	}
 	s = strings.ToLower(strings.TrimSpace(s))
 
-	if _, ok := HOSTNAMES[s]; !ok {
-		fmt.Println("Invalid server")
+	servers := []string{s}
+	if s == "all" {
+		servers = sortedKeys(HOSTNAMES)
+	} else if _, ok := HOSTNAMES[s]; !ok {
+		usageError("Invalid server")
+	}
+
+	if *exportTo != "" {
+		if s == "all" {
+			usageError("-export-archive needs a single server")
+		}
+		m, err := exportArchive(s, *exportTo)
+		if err != nil {
+			fmt.Println("Export failed:", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Exported %d profiles in %d buckets to %s\n", m.Profiles, m.Buckets, *exportTo)
 		return
 	}
 
-	if err := run(s); err != nil {
-		fmt.Println("Error:", err)
+	client, err := newClient()
+	if err != nil {
+		usageError(fmt.Sprint("Error: ", err))
+	}
+
+	if *selfTest {
+		failed := false
+		for _, server := range servers {
+			if err := selftest(client, HOSTNAMES[server]); err != nil {
+				fmt.Printf("Self-test failed for %s: %v\n", server, err)
+				failed = true
+			}
+		}
+		if failed {
+			os.Exit(1)
+		}
+		return
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if *maxDuration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *maxDuration)
+		defer cancel()
+	}
+
+	if *pprofAt != "" {
+		startPprof(ctx, *pprofAt)
+	}
+
+	scrape := func(server string) {
+		if err := run(ctx, server, client); err != nil {
+			fmt.Printf("Error (%s): %v\n", server, err)
+		}
+	}
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		// A dry run lists one server's URLs after another instead of
+		// interleaving them.
+		if *dryRun {
+			scrape(server)
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			scrape(server)
+		}()
+	}
+	wg.Wait()
+
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		fmt.Printf("Stopped after -max-duration %s.\n", *maxDuration)
+	}
+	if !*dryRun {
+		fmt.Println(client.Summary())
+		if *runReport != "" {
+			if err := writeRunReport(*runReport, servers, client, started); err != nil {
+				fmt.Println("Could not write run report:", err)
+			}
+		}
 	}
 	fmt.Println("Finished.")
 }
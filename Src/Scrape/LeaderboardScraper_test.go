@@ -0,0 +1,1684 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func setFlag[T any](t testing.TB, p *T, v T) {
+	t.Helper()
+	old := *p
+	*p = v
+	t.Cleanup(func() { *p = old })
+}
+
+// setHost points a server name at a test server for the rest of the test.
+func setHost(t *testing.T, server, base string) {
+	t.Helper()
+	old, ok := HOSTNAMES[server]
+	HOSTNAMES[server] = base + "/"
+	t.Cleanup(func() {
+		if ok {
+			HOSTNAMES[server] = old
+		} else {
+			delete(HOSTNAMES, server)
+		}
+	})
+}
+
+func testClient() *RetryClient {
+	return &RetryClient{Client: &http.Client{Timeout: time.Second}, Retries: 3, Backoff: time.Millisecond}
+}
+
+func TestCustomCAFile(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	caPath := filepath.Join(t.TempDir(), "ca.pem")
+	block := &pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}
+	if err := os.WriteFile(caPath, pem.EncodeToMemory(block), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		caFile   string
+		insecure bool
+		ok       bool
+	}{
+		{"system roots only", "", false, false},
+		{"custom CA", caPath, false, true},
+		{"insecure", "", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, caFile, tt.caFile)
+			setFlag(t, insecure, tt.insecure)
+			tr, err := newTransport()
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := (&http.Client{Transport: tr}).Get(srv.URL)
+			if err == nil {
+				resp.Body.Close()
+			}
+			if (err == nil) != tt.ok {
+				t.Fatalf("GET error = %v, want ok=%v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestCAFileWithoutCertificates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "empty.pem")
+	os.WriteFile(path, []byte("not a certificate"), 0644)
+	setFlag(t, caFile, path)
+	if _, err := newTransport(); err == nil {
+		t.Fatal("newTransport accepted a CA file without certificates")
+	}
+}
+
+func TestIdenticalDataSavesIdenticalBytes(t *testing.T) {
+	dir := t.TempDir()
+	build := func(order []string) map[string]any {
+		m := make(map[string]any)
+		for _, k := range order {
+			m[k] = map[string]any{"latest": map[string]any{"username": "user" + k, "rank": k}, "pages": []int{1}}
+		}
+		return m
+	}
+
+	var files [][]byte
+	for i, order := range [][]string{{"1", "2", "3", "10"}, {"10", "3", "2", "1"}} {
+		path := filepath.Join(dir, fmt.Sprintf("%d.json", i))
+		if err := atomicWrite(path, build(order)); err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, b)
+	}
+	if !bytes.Equal(files[0], files[1]) {
+		t.Fatalf("identical data serialized differently:\n%s\n%s", files[0], files[1])
+	}
+}
+
+func TestUnchangedDirtyBucketIsNotRewritten(t *testing.T) {
+	bm := NewBucketManager(t.TempDir(), false)
+	bm.Update("7", map[string]any{"username": "alice", "rank": 5.0}, 1)
+	if err := bm.SaveDirty(); err != nil {
+		t.Fatal(err)
+	}
+	path := bm.path([2]int{1, BUCKET_SIZE})
+	before, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := bm.get(1, BUCKET_SIZE)
+	b.Dirty = true
+	if err := bm.SaveDirty(); err != nil {
+		t.Fatal(err)
+	}
+	after, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(before, after) {
+		t.Fatal("an unchanged dirty bucket was rewritten")
+	}
+	if b.Dirty {
+		t.Fatal("the dirty flag was not cleared")
+	}
+
+	bm.Update("8", map[string]any{"username": "bob", "rank": 6.0}, 1)
+	if err := bm.SaveDirty(); err != nil {
+		t.Fatal(err)
+	}
+	if changed, _ := os.Stat(path); os.SameFile(before, changed) {
+		t.Fatal("a changed bucket was not rewritten")
+	}
+}
+
+func TestPageCacheHitAndExpiry(t *testing.T) {
+	pc := &PageCache{Dir: t.TempDir(), TTL: time.Minute}
+	body := []byte(`{"data":[{"id":1}]}`)
+
+	if _, ok := pc.Load("www", 3); ok {
+		t.Fatal("empty cache reported a hit")
+	}
+	pc.Store("www", 3, body)
+	got, ok := pc.Load("www", 3)
+	if !ok || !bytes.Equal(got, body) {
+		t.Fatalf("Load after Store = %q, %v", got, ok)
+	}
+	if _, ok := pc.Load("br", 3); ok {
+		t.Fatal("cache is not keyed by server")
+	}
+
+	stale := time.Now().Add(-2 * time.Minute)
+	if err := os.Chtimes(pc.path("www", 3), stale, stale); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := pc.Load("www", 3); ok {
+		t.Fatal("an expired entry was served")
+	}
+}
+
+func TestFetchPageUsesCache(t *testing.T) {
+	var hits atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		fmt.Fprint(w, `{"data":[{"id":1},{"id":2}]}`)
+	}))
+	defer srv.Close()
+	setHost(t, "www", srv.URL)
+
+	client := testClient()
+	cache := &PageCache{Dir: t.TempDir(), TTL: time.Minute}
+	for i := 0; i < 3; i++ {
+		rows, err := fetchPage(client, cache, "www", 1)
+		if err != nil || len(rows) != 2 {
+			t.Fatalf("fetchPage = %v, %v", rows, err)
+		}
+	}
+	if n := hits.Load(); n != 1 {
+		t.Fatalf("server was hit %d times, want 1", n)
+	}
+}
+
+// pageServer answers leaderboard requests with one row per page, ranked by
+// page number, after delay.
+func pageServer(t *testing.T, delay time.Duration) (*httptest.Server, *atomic.Int64) {
+	t.Helper()
+	var served atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		page := r.URL.Query().Get("page")
+		served.Add(1)
+		fmt.Fprintf(w, `{"data":[{"id":%s,"username":"user%s","rank":%s}]}`, page, page, page)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &served
+}
+
+// storedProfiles counts the profiles saved under Data/<server>.
+func storedProfiles(t *testing.T, server string) int {
+	t.Helper()
+	n := 0
+	filepath.WalkDir(filepath.Join("Data", server), func(path string, d fs.DirEntry, err error) error {
+		if err == nil && d.Name() == *dataName {
+			var data map[string]any
+			if err := loadJSON(path, &data); err != nil {
+				t.Fatal(err)
+			}
+			n += len(data)
+		}
+		return nil
+	})
+	return n
+}
+
+func TestCancelDrainsFetchedPages(t *testing.T) {
+	t.Chdir(t.TempDir())
+	srv, served := pageServer(t, 40*time.Millisecond)
+	setHost(t, "www", srv.URL)
+
+	var late atomic.Int64
+	ctx, cancel := context.WithCancel(context.Background())
+	srv.Config.Handler = func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if ctx.Err() != nil {
+				late.Add(1)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}(srv.Config.Handler)
+	time.AfterFunc(150*time.Millisecond, cancel)
+
+	if err := run(ctx, "www", testClient()); err != nil {
+		t.Fatal(err)
+	}
+
+	done := served.Load()
+	if done == 0 {
+		t.Fatal("no pages were fetched before the cancel")
+	}
+	if n := storedProfiles(t, "www"); int64(n) != done {
+		t.Fatalf("stored %d profiles, but %d pages were fetched", n, done)
+	}
+	if n := late.Load(); n > 0 {
+		t.Fatalf("workers started %d queued pages after the cancel", n)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := served.Load(); n != done {
+		t.Fatalf("workers fetched %d more pages after run returned", n-done)
+	}
+}
+
+func TestDrainIngestsPendingData(t *testing.T) {
+	dataCh := make(chan PageData, 3)
+	for p := 1; p <= 3; p++ {
+		dataCh <- PageData{Page: p}
+	}
+	close(dataCh)
+
+	var got []int
+	drain(dataCh, func(d PageData) { got = append(got, d.Page) })
+	if len(got) != 3 {
+		t.Fatalf("drain ingested pages %v, want 1..3", got)
+	}
+}
+
+func TestRetryCountIsHonored(t *testing.T) {
+	var attempts atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	for _, n := range []int{1, 3, 5} {
+		attempts.Store(0)
+		client := testClient()
+		client.Retries = n
+		if _, err := client.Get(srv.URL); err == nil {
+			t.Fatalf("retries=%d: Get succeeded against a failing server", n)
+		}
+		if got := attempts.Load(); got != int64(n) {
+			t.Errorf("retries=%d: server saw %d attempts", n, got)
+		}
+	}
+}
+
+func TestInvalidFlagsExitWithUsageStatus(t *testing.T) {
+	if args := os.Getenv("SCRAPER_MAIN_ARGS"); args != "" {
+		os.Args = append([]string{"scraper"}, strings.Fields(args)...)
+		main()
+		return
+	}
+
+	for _, args := range []string{"-retries 0", "-backoff-base 0s", "-page-step 0", "-server nowhere", "-server www -retry-status 999"} {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestInvalidFlagsExitWithUsageStatus$")
+		cmd.Env = append(os.Environ(), "SCRAPER_MAIN_ARGS="+args)
+		var stdout, stderr bytes.Buffer
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		err := cmd.Run()
+
+		var exit *exec.ExitError
+		if !errors.As(err, &exit) || exit.ExitCode() != 2 {
+			t.Errorf("%s: exit = %v, want status 2", args, err)
+		}
+		if stderr.Len() == 0 || stdout.Len() != 0 {
+			t.Errorf("%s: stdout %q, stderr %q; want the message on stderr only", args, stdout.String(), stderr.String())
+		}
+	}
+}
+
+func TestDryScrapeListsServersInTurn(t *testing.T) {
+	if args := os.Getenv("SCRAPER_MAIN_ARGS"); args != "" {
+		os.Args = append([]string{"scraper"}, strings.Fields(args)...)
+		main()
+		return
+	}
+
+	const pages = 2000
+	cmd := exec.Command(os.Args[0], "-test.run=^TestDryScrapeListsServersInTurn$")
+	cmd.Env = append(os.Environ(), fmt.Sprintf("SCRAPER_MAIN_ARGS=-server all -dry-scrape -max-pages %d", pages), "GOMAXPROCS=4")
+	cmd.Dir = t.TempDir()
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var order []string
+	counts := map[string]int{}
+	for _, line := range strings.Split(string(out), "\n") {
+		u, err := url.Parse(line)
+		if err != nil || u.Host == "" {
+			continue
+		}
+		if len(order) == 0 || order[len(order)-1] != u.Host {
+			order = append(order, u.Host)
+		}
+		counts[u.Host]++
+	}
+	if len(order) != len(HOSTNAMES) {
+		t.Fatalf("URLs came from hosts in order %v, want each of the %d servers once", order, len(HOSTNAMES))
+	}
+	for host, n := range counts {
+		if n != pages {
+			t.Errorf("%s: listed %d URLs, want %d", host, n, pages)
+		}
+	}
+}
+
+func TestSingleFileStoreRoundTrip(t *testing.T) {
+	root := t.TempDir()
+	bm := NewBucketManager(root, true)
+	bm.Update("1", map[string]any{"username": "alice", "rank": 1.0}, 1)
+	bm.Update("2", map[string]any{"username": "bob", "rank": 50000.0}, 125)
+	if err := bm.SaveDirty(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, _ := os.ReadDir(root)
+	if len(entries) != 1 || entries[0].Name() != *dataName {
+		t.Fatalf("single-file store wrote %v, want only %s", entries, *dataName)
+	}
+
+	reloaded := NewBucketManager(root, true).get(0, 0)
+	if len(reloaded.Data) != 2 {
+		t.Fatalf("reloaded %d profiles, want 2", len(reloaded.Data))
+	}
+	bob := reloaded.Data["2"].(map[string]any)
+	if name := bob["latest"].(map[string]any)["username"]; name != "bob" {
+		t.Fatalf("reloaded username = %v", name)
+	}
+	if pages := extractPages(bob["pages"]); len(pages) != 1 || pages[0] != 125 {
+		t.Fatalf("reloaded pages = %v", pages)
+	}
+}
+
+// requestTimes records when each request reaches srv.
+func requestTimes(srv *httptest.Server) func() []time.Time {
+	var mu sync.Mutex
+	var times []time.Time
+	next := srv.Config.Handler
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		times = append(times, time.Now())
+		mu.Unlock()
+		next.ServeHTTP(w, r)
+	})
+	return func() []time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		out := slices.Clone(times)
+		slices.SortFunc(out, time.Time.Compare)
+		return out
+	}
+}
+
+func TestPageDelaySpacesDispatches(t *testing.T) {
+	t.Chdir(t.TempDir())
+	srv, _ := pageServer(t, 0)
+	setHost(t, "www", srv.URL)
+	times := requestTimes(srv)
+
+	const delay = 40 * time.Millisecond
+	setFlag(t, maxPages, 5)
+	setFlag(t, pageDelay, delay)
+	if err := run(context.Background(), "www", testClient()); err != nil {
+		t.Fatal(err)
+	}
+
+	got := times()
+	if len(got) != 5 {
+		t.Fatalf("fetched %d pages, want 5", len(got))
+	}
+	for i := 1; i < len(got); i++ {
+		if gap := got[i].Sub(got[i-1]); gap < delay*3/4 {
+			t.Errorf("pages %d and %d were fetched %v apart, want about %v", i, i+1, gap, delay)
+		}
+	}
+}
+
+func TestPageDelayDoesNotBlockShutdown(t *testing.T) {
+	t.Chdir(t.TempDir())
+	srv, _ := pageServer(t, 0)
+	setHost(t, "www", srv.URL)
+	setFlag(t, pageDelay, time.Hour)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := run(ctx, "www", testClient()); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("run took %v to stop during a page delay", d)
+	}
+}
+
+func TestRankToPage(t *testing.T) {
+	tests := []struct {
+		rank, perPage, page int
+	}{
+		{1, 400, 1},
+		{400, 400, 1},
+		{401, 400, 2},
+		{20000, 400, 50},
+		{1, 50, 1},
+		{50, 50, 1},
+		{51, 50, 2},
+		{20001, 50, 401},
+	}
+	for _, tt := range tests {
+		if got := pageOf(tt.rank, tt.perPage); got != tt.page {
+			t.Errorf("pageOf(%d, %d) = %d, want %d", tt.rank, tt.perPage, got, tt.page)
+		}
+	}
+
+	setFlag(t, fromRank, 801)
+	setFlag(t, toRank, 2000)
+	if start, stop := pageRange(map[string]any{"page": 9.0}); start != 3 || stop != 5 {
+		t.Errorf("-from-rank 801 -to-rank 2000 crawls pages %d..%d, want 3..5", start, stop)
+	}
+}
+
+// setClock makes clock return the times in order, one per call.
+func setClock(t *testing.T, times ...time.Time) {
+	t.Helper()
+	old := clock
+	clock = func() time.Time {
+		now := times[0]
+		if len(times) > 1 {
+			times = times[1:]
+		}
+		return now
+	}
+	t.Cleanup(func() { clock = old })
+}
+
+func TestSeenTimestamps(t *testing.T) {
+	t0 := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	t1 := t0.Add(24 * time.Hour)
+	setClock(t, t0, t1)
+
+	bm := NewBucketManager(t.TempDir(), false)
+	bm.Update("7", map[string]any{"username": "alice", "rank": 5.0}, 1)
+	bm.Update("7", map[string]any{"username": "alice2", "rank": 5.0}, 1)
+
+	entry := bm.get(1, BUCKET_SIZE).Data["7"].(map[string]any)
+	if got := entry["first_seen"]; got != t0.Format(time.RFC3339) {
+		t.Errorf("first_seen = %v, want the first update's time", got)
+	}
+	if got := entry["last_seen"]; got != t1.Format(time.RFC3339) {
+		t.Errorf("last_seen = %v, want the second update's time", got)
+	}
+}
+
+func TestRescrapingIdenticalData(t *testing.T) {
+	t0 := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		name    string
+		later   time.Duration
+		rewrite bool
+	}{
+		{"within refresh window", 10 * time.Minute, false},
+		{"refresh window elapsed", LAST_SEEN_REFRESH, true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t1 := t0.Add(tc.later)
+			setClock(t, t0, t0, t1, t1)
+
+			root := t.TempDir()
+			scrape := func() []byte {
+				bm := NewBucketManager(root, false)
+				bm.Update("1", map[string]any{"username": "alice", "rank": 1.0}, 1)
+				bm.Update("2", map[string]any{"username": "bob", "rank": 2.0}, 1)
+				if err := bm.SaveDirty(); err != nil {
+					t.Fatal(err)
+				}
+				b, err := os.ReadFile(bm.path([2]int{1, BUCKET_SIZE}))
+				if err != nil {
+					t.Fatal(err)
+				}
+				return b
+			}
+
+			first, second := scrape(), scrape()
+			if !tc.rewrite {
+				if !bytes.Equal(first, second) {
+					t.Fatalf("re-scraping identical data %s later changed the bucket:\n%s\n%s", tc.later, first, second)
+				}
+				return
+			}
+
+			var data map[string]map[string]any
+			if err := json.Unmarshal(second, &data); err != nil {
+				t.Fatal(err)
+			}
+			want := t1.Format(time.RFC3339)
+			for uid, ent := range data {
+				if ent["last_seen"] != want {
+					t.Errorf("profile %s last_seen on disk = %v, want %s", uid, ent["last_seen"], want)
+				}
+			}
+		})
+	}
+}
+
+func TestConcurrentUpdates(t *testing.T) {
+	bm := NewBucketManager(t.TempDir(), false)
+
+	// Each uid is updated by two goroutines and moves to another bucket
+	// between its first and second page.
+	const goroutines, perGoroutine = 16, 200
+	const uids = goroutines * perGoroutine / 2
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perGoroutine; i++ {
+				id := (g*perGoroutine + i) % uids
+				rank := float64(id*37%60000 + 1)
+				uid := strconv.Itoa(id)
+				bm.Update(uid, map[string]any{"username": "user" + uid, "rank": rank}, 1)
+				bm.Update(uid, map[string]any{"username": "user" + uid, "rank": rank + BUCKET_SIZE}, 2)
+				if i%50 == 0 {
+					if err := bm.SaveDirty(); err != nil {
+						t.Error(err)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if err := bm.SaveDirty(); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded := NewBucketManager(bm.root, false)
+	total := 0
+	for key := range bm.cache {
+		b := reloaded.get(key[0], key[1])
+		for uid, v := range b.Data {
+			ent := v.(map[string]any)
+			if start, _ := rankBucket(entryRank(ent["latest"].(map[string]any))); start != key[0] {
+				t.Errorf("profile %s with rank %v stored in bucket %v", uid, ent["latest"], key)
+			}
+			if pages := extractPages(ent["pages"]); !slices.Equal(pages, []int{1, 2}) {
+				t.Errorf("profile %s has pages %v, want [1 2]", uid, pages)
+			}
+		}
+		total += len(b.Data)
+	}
+	if total != uids {
+		t.Fatalf("stored %d profiles, want %d", total, uids)
+	}
+}
+
+func TestConcurrentUpdatesOfOneUID(t *testing.T) {
+	t0 := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	setClock(t, t0, t0.Add(time.Hour))
+	bm := NewBucketManager(t.TempDir(), false)
+	bm.Update("7", map[string]any{"username": "alice", "rank": 1.0}, 0)
+
+	const goroutines, perGoroutine = 8, 100
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			for i := 0; i < perGoroutine; i++ {
+				rank := float64((g*perGoroutine+i)%5*BUCKET_SIZE + 1)
+				bm.Update("7", map[string]any{"username": "alice", "rank": rank}, g*perGoroutine+i+1)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	var found [][2]int
+	var entry map[string]any
+	for key, b := range bm.cache {
+		if v, ok := b.Data["7"]; ok {
+			found = append(found, key)
+			entry = v.(map[string]any)
+		}
+	}
+	if len(found) != 1 {
+		t.Fatalf("profile stored in buckets %v, want exactly one", found)
+	}
+	if found[0] != bm.index["7"] {
+		t.Errorf("profile stored in bucket %v, index says %v", found[0], bm.index["7"])
+	}
+	if pages := extractPages(entry["pages"]); len(pages) != goroutines*perGoroutine+1 {
+		t.Errorf("profile kept %d pages, want %d", len(pages), goroutines*perGoroutine+1)
+	}
+	if entry["first_seen"] != t0.Format(time.RFC3339) {
+		t.Errorf("first_seen = %v, want %s", entry["first_seen"], t0.Format(time.RFC3339))
+	}
+}
+
+func TestLoadJSONToleratesBOMAndTrailingWhitespace(t *testing.T) {
+	for _, raw := range []string{
+		`{"page": 4}`,
+		"\ufeff" + `{"page": 4}`,
+		`{"page": 4}` + "\n \t\r\n",
+		"\ufeff" + `{"page": 4}` + "  \n",
+	} {
+		path := filepath.Join(t.TempDir(), "last.json")
+		os.WriteFile(path, []byte(raw), 0644)
+		var last map[string]any
+		if err := loadJSON(path, &last); err != nil || last["page"] != 4.0 {
+			t.Errorf("loadJSON(%q) = %v, %v", raw, last, err)
+		}
+	}
+}
+
+func TestFilteredRowsAreNotStored(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"data":[
+			{"id":1,"username":"alice","rank":1},
+			{"id":2,"username":"  ","rank":2},
+			{"id":3,"username":"carol","rank":60000},
+			{"id":4,"username":"dave"}
+		]}`)
+	}))
+	defer srv.Close()
+	setHost(t, "www", srv.URL)
+	setFlag(t, maxPages, 1)
+
+	tests := []struct {
+		name        string
+		requireName bool
+		maxStore    int
+		want        int
+	}{
+		{"no filter", false, 0, 4},
+		{"require username", true, 0, 3},
+		{"max store rank", false, 50000, 2},
+		{"both", true, 50000, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			setFlag(t, requireName, tt.requireName)
+			setFlag(t, maxStore, tt.maxStore)
+			if err := run(context.Background(), "www", testClient()); err != nil {
+				t.Fatal(err)
+			}
+			if n := storedProfiles(t, "www"); n != tt.want {
+				t.Fatalf("stored %d profiles, want %d", n, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelftest(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		wantErr string
+	}{
+		{"good", `{"data":[{"id":1,"username":"a"},{"id":2,"username":"b"}]}`, ""},
+		{"other ID field", `{"data":[{"profile_id":1}]}`, ""},
+		{"not JSON", `<html>maintenance</html>`, "not a JSON object"},
+		{"no data array", `{"rows":[]}`, `no "data" array`},
+		{"empty data", `{"data":[]}`, "empty"},
+		{"row not an object", `{"data":[1]}`, "row 0 is not an object"},
+		{"no ID field", `{"data":[{"id":1},{"username":"b"}]}`, "row 1 has none of the ID fields"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, tt.body)
+			}))
+			defer srv.Close()
+
+			err := selftest(testClient(), srv.URL)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("selftest failed on a good shape: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("selftest error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadJSONDistinguishesAbsentAndCorrupt(t *testing.T) {
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "valid.json")
+	corrupt := filepath.Join(dir, "corrupt.json")
+	os.WriteFile(valid, []byte(`{"page": 12}`), 0644)
+	os.WriteFile(corrupt, []byte(`{"page": 1`), 0644)
+
+	tests := []struct {
+		name    string
+		path    string
+		absent  bool
+		corrupt bool
+	}{
+		{"absent", filepath.Join(dir, "missing.json"), true, false},
+		{"valid", valid, false, false},
+		{"corrupt", corrupt, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var last map[string]any
+			err := loadJSON(tt.path, &last)
+			if got := errors.Is(err, fs.ErrNotExist); got != tt.absent {
+				t.Errorf("absent = %v (err %v)", got, err)
+			}
+			if got := err != nil && strings.Contains(err.Error(), "is corrupt"); got != tt.corrupt {
+				t.Errorf("corrupt = %v (err %v)", got, err)
+			}
+			if err == nil && last["page"] != 12.0 {
+				t.Errorf("loaded %v", last)
+			}
+		})
+	}
+}
+
+func TestCorruptLastJSONRestartsAndIsKept(t *testing.T) {
+	t.Chdir(t.TempDir())
+	srv, _ := pageServer(t, 0)
+	setHost(t, "www", srv.URL)
+	setFlag(t, maxPages, 2)
+
+	lastPath := filepath.Join("Data", "www", "last.json")
+	os.MkdirAll(filepath.Dir(lastPath), 0755)
+	os.WriteFile(lastPath, []byte(`{"page": 9`), 0644)
+
+	if err := run(context.Background(), "www", testClient()); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(lastPath + ".corrupt"); err != nil || string(b) != `{"page": 9` {
+		t.Fatalf("the corrupt last.json was not kept aside: %q, %v", b, err)
+	}
+	var last map[string]any
+	if err := loadJSON(lastPath, &last); err != nil || last["page"] != 3.0 {
+		t.Fatalf("after restarting from page 1, last.json = %v, %v; want page 3", last, err)
+	}
+}
+
+// requestedPages records the page parameter of each request reaching srv.
+func requestedPages(srv *httptest.Server) func() []int {
+	var mu sync.Mutex
+	var pages []int
+	next := srv.Config.Handler
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		mu.Lock()
+		pages = append(pages, p)
+		mu.Unlock()
+		next.ServeHTTP(w, r)
+	})
+	return func() []int {
+		mu.Lock()
+		defer mu.Unlock()
+		out := slices.Clone(pages)
+		slices.Sort(out)
+		return out
+	}
+}
+
+func TestPageStepSequence(t *testing.T) {
+	t.Chdir(t.TempDir())
+	srv, _ := pageServer(t, 0)
+	setHost(t, "www", srv.URL)
+	pages := requestedPages(srv)
+	setFlag(t, pageStep, 10)
+	setFlag(t, maxPages, 4)
+
+	lastPath := filepath.Join("Data", "www", "last.json")
+	os.MkdirAll(filepath.Dir(lastPath), 0755)
+	atomicWrite(lastPath, map[string]any{"page": 3})
+
+	if err := run(context.Background(), "www", testClient()); err != nil {
+		t.Fatal(err)
+	}
+	if got := pages(); !slices.Equal(got, []int{3, 13, 23, 33}) {
+		t.Fatalf("requested pages %v, want 3, 13, 23, 33", got)
+	}
+	var last map[string]any
+	if err := loadJSON(lastPath, &last); err != nil || last["page"] != 43.0 {
+		t.Fatalf("last.json = %v, %v; want page 43", last, err)
+	}
+
+	b := NewBucketManager(filepath.Join("Data", "www"), false).get(1, BUCKET_SIZE)
+	if pages := extractPages(b.Data["13"].(map[string]any)["pages"]); !slices.Equal(pages, []int{13}) {
+		t.Fatalf("profile 13 recorded pages %v", pages)
+	}
+}
+
+func TestRankMoveAcrossRunsKeepsOneEntry(t *testing.T) {
+	root := t.TempDir()
+	first := NewBucketManager(root, false)
+	first.Update("7", map[string]any{"username": "alice", "rank": 25000.0}, 63)
+	first.Update("8", map[string]any{"username": "bob", "rank": 25001.0}, 63)
+	if err := first.SaveDirty(); err != nil {
+		t.Fatal(err)
+	}
+
+	second := NewBucketManager(root, false)
+	second.Update("7", map[string]any{"username": "alice", "rank": 10.0}, 1)
+	if err := second.SaveDirty(); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded := NewBucketManager(root, false)
+	top := reloaded.get(1, BUCKET_SIZE).Data
+	old := reloaded.get(BUCKET_SIZE+1, 2*BUCKET_SIZE).Data
+	if _, ok := old["7"]; ok {
+		t.Fatal("the stale entry from the earlier run was left in its old bucket")
+	}
+	if _, ok := old["8"]; !ok {
+		t.Fatal("an unrelated profile was dropped from the old bucket")
+	}
+	entry, ok := top["7"].(map[string]any)
+	if !ok {
+		t.Fatal("the profile is missing from its new bucket")
+	}
+	if pages := extractPages(entry["pages"]); !slices.Equal(pages, []int{1, 63}) {
+		t.Fatalf("pages = %v, want both runs' pages", pages)
+	}
+}
+
+func TestRankMoveWithinRunKeepsOneEntry(t *testing.T) {
+	bm := NewBucketManager(t.TempDir(), false)
+	bm.Update("7", map[string]any{"username": "alice", "rank": 25000.0}, 63)
+	bm.Update("7", map[string]any{"username": "alice", "rank": 19999.0}, 50)
+
+	if _, ok := bm.get(BUCKET_SIZE+1, 2*BUCKET_SIZE).Data["7"]; ok {
+		t.Fatal("the profile is still in the bucket of its earlier rank")
+	}
+	if _, ok := bm.get(1, BUCKET_SIZE).Data["7"]; !ok {
+		t.Fatal("the profile is missing from the bucket of its latest rank")
+	}
+}
+
+func TestShortPages(t *testing.T) {
+	// Pages 1-5 exist; page 2 is always truncated and page 5 is the short
+	// final page.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		switch {
+		case page == 2 || page == 5:
+			fmt.Fprintf(w, `{"data":[{"id":%d}]}`, page)
+		case page < 5:
+			fmt.Fprintf(w, `{"data":[{"id":%d},{"id":%d},{"id":%d}]}`, page, page+100, page+200)
+		default:
+			fmt.Fprint(w, `{"data":[]}`)
+		}
+	}))
+	defer srv.Close()
+	setHost(t, "www", srv.URL)
+	setFlag(t, minRows, 3)
+
+	tests := []struct {
+		page int
+		rows int
+		ok   bool
+	}{
+		{1, 3, true},
+		{2, 0, false},
+		{5, 1, true},
+		{6, 0, true},
+	}
+	for _, tt := range tests {
+		rows, err := fetchFullPage(testClient(), nil, "www", tt.page)
+		if (err == nil) != tt.ok || len(rows) != tt.rows {
+			t.Errorf("page %d: %d rows, err %v; want %d rows, ok=%v", tt.page, len(rows), err, tt.rows, tt.ok)
+		}
+	}
+}
+
+func TestLockIsExclusive(t *testing.T) {
+	dir := t.TempDir()
+	release, err := acquireLock(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = acquireLock(dir)
+	if err == nil || !strings.Contains(err.Error(), "already running") || !strings.Contains(err.Error(), strconv.Itoa(os.Getpid())) {
+		t.Fatalf("second acquisition error = %v, want it to name the running pid", err)
+	}
+
+	release()
+	again, err := acquireLock(dir)
+	if err != nil {
+		t.Fatalf("the lock was not released: %v", err)
+	}
+	again()
+}
+
+func TestRunRefusesALockedServer(t *testing.T) {
+	t.Chdir(t.TempDir())
+	srv, served := pageServer(t, 0)
+	setHost(t, "www", srv.URL)
+	setFlag(t, maxPages, 1)
+
+	outdir := filepath.Join("Data", "www")
+	os.MkdirAll(outdir, 0755)
+	release, err := acquireLock(outdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := run(context.Background(), "www", testClient()); err == nil {
+		t.Fatal("run started on a locked server directory")
+	}
+	if served.Load() != 0 {
+		t.Fatal("the locked run fetched pages")
+	}
+	release()
+
+	if err := run(context.Background(), "www", testClient()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(outdir, "lock")); !os.IsNotExist(err) {
+		t.Fatalf("run left its lock behind: %v", err)
+	}
+}
+
+func TestSharedClientCapsAggregateRate(t *testing.T) {
+	t.Chdir(t.TempDir())
+	srv, _ := pageServer(t, 0)
+	times := requestTimes(srv)
+	setHost(t, "www", srv.URL)
+	setHost(t, "br", srv.URL)
+	setFlag(t, maxPages, 8)
+
+	const rate = 50.0
+	client := testClient()
+	client.Limiter = NewRateLimiter(rate)
+
+	var wg sync.WaitGroup
+	for _, server := range []string{"www", "br"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := run(context.Background(), server, client); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	got := times()
+	if len(got) != 16 {
+		t.Fatalf("served %d requests, want 16", len(got))
+	}
+	interval := time.Duration(float64(time.Second) / rate)
+	if span := got[len(got)-1].Sub(got[0]); span < 15*interval*3/4 {
+		t.Fatalf("16 requests from two servers took %v; a shared %v/s limit needs about %v", span, rate, 15*interval)
+	}
+	for i := 1; i < len(got); i++ {
+		if gap := got[i].Sub(got[i-1]); gap < interval/2 {
+			t.Errorf("requests %d and %d were %v apart, want about %v", i, i+1, gap, interval)
+		}
+	}
+}
+
+func TestCustomDataFilename(t *testing.T) {
+	for _, name := range []string{"data.json", "data-2024-06.json"} {
+		t.Run(name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			srv, _ := pageServer(t, 0)
+			setHost(t, "www", srv.URL)
+			setFlag(t, maxPages, 3)
+			setFlag(t, dataName, name)
+
+			if err := run(context.Background(), "www", testClient()); err != nil {
+				t.Fatal(err)
+			}
+			var files []string
+			filepath.WalkDir("Data", func(path string, d fs.DirEntry, err error) error {
+				if err == nil && filepath.Ext(path) == ".json" && filepath.Dir(path) != filepath.Join("Data", "www") {
+					files = append(files, d.Name())
+				}
+				return nil
+			})
+			if len(files) == 0 || slices.ContainsFunc(files, func(f string) bool { return f != name }) {
+				t.Fatalf("bucket files %v, want only %s", files, name)
+			}
+			if n := storedProfiles(t, "www"); n != 3 {
+				t.Fatalf("stored %d profiles, want 3", n)
+			}
+
+			bm := NewBucketManager(filepath.Join("Data", "www"), false)
+			if n := len(bm.get(1, 20000).Data); n != 3 {
+				t.Fatalf("reloaded %d profiles from %s, want 3", n, name)
+			}
+		})
+	}
+}
+
+func TestRepeatedSaveFailuresStopTheRun(t *testing.T) {
+	t.Chdir(t.TempDir())
+	srv, served := pageServer(t, 2*time.Millisecond)
+	setHost(t, "www", srv.URL)
+	setFlag(t, firstSave, 20*time.Millisecond)
+
+	// A file where the first bucket's directory belongs makes every save
+	// of that bucket fail, the way a full disk would.
+	if err := os.MkdirAll(filepath.Join("Data", "www"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join("Data", "www", "1to20000"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- run(context.Background(), "www", testClient()) }()
+	var err error
+	select {
+	case err = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the run kept fetching after repeated save failures")
+	}
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("stopped after %d failed saves", MAX_SAVE_FAILURES)) {
+		t.Fatalf("run returned %v, want a failed-saves error", err)
+	}
+	stopped := served.Load()
+	time.Sleep(50 * time.Millisecond)
+	if n := served.Load(); n != stopped {
+		t.Fatalf("%d more pages were fetched after the run stopped", n-stopped)
+	}
+}
+
+func TestFailingPageIsRequeuedAtTheInterval(t *testing.T) {
+	t.Chdir(t.TempDir())
+	var mu sync.Mutex
+	var failedAt []time.Time
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page := r.URL.Query().Get("page")
+		if page == "2" {
+			mu.Lock()
+			failedAt = append(failedAt, time.Now())
+			mu.Unlock()
+			http.Error(w, "broken page", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, `{"data":[{"id":%s,"username":"user%s","rank":%s}]}`, page, page, page)
+	}))
+	t.Cleanup(srv.Close)
+	setHost(t, "www", srv.URL)
+	setFlag(t, maxPages, 3)
+
+	const gap = 40 * time.Millisecond
+	setFlag(t, requeueGap, gap)
+	client := testClient()
+	client.Retries = 1
+
+	done := make(chan error, 1)
+	go func() { done <- run(context.Background(), "www", client) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the run did not end after the failing page ran out of re-queues")
+	}
+
+	if len(failedAt) != 1+MAX_REQUEUES {
+		t.Fatalf("page 2 was fetched %d times, want %d", len(failedAt), 1+MAX_REQUEUES)
+	}
+	for i := 1; i < len(failedAt); i++ {
+		// The interval runs from dispatch, which is a little before the
+		// request reaches the server.
+		if d := failedAt[i].Sub(failedAt[i-1]); d < gap*9/10 {
+			t.Errorf("re-queue %d came %v after the previous attempt, want at least %v", i, d, gap)
+		}
+	}
+	if n := storedProfiles(t, "www"); n != 2 {
+		t.Fatalf("stored %d profiles, want the 2 pages that succeeded", n)
+	}
+}
+
+func TestStdoutNDJSON(t *testing.T) {
+	for _, noStoreRun := range []bool{false, true} {
+		t.Run(fmt.Sprintf("no-store=%v", noStoreRun), func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			srv, _ := pageServer(t, time.Millisecond)
+			setHost(t, "www", srv.URL)
+			setHost(t, "br", srv.URL)
+			setFlag(t, maxPages, 10)
+			setFlag(t, noStore, noStoreRun)
+
+			var out bytes.Buffer
+			setFlag(t, &rowStream, NewRowStream(&out))
+
+			var wg sync.WaitGroup
+			for _, server := range []string{"www", "br"} {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if err := run(context.Background(), server, testClient()); err != nil {
+						t.Error(err)
+					}
+				}()
+			}
+			wg.Wait()
+
+			seen := map[string]bool{}
+			for _, line := range strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n") {
+				var row struct {
+					Server string
+					UID    string
+					Page   int
+					Latest map[string]any
+				}
+				if err := json.Unmarshal([]byte(line), &row); err != nil {
+					t.Fatalf("interleaved or invalid line %q: %v", line, err)
+				}
+				if row.UID != strconv.Itoa(row.Page) || row.Latest["username"] != "user"+row.UID {
+					t.Errorf("line %q does not carry its uid, page and row", line)
+				}
+				seen[row.Server+"/"+row.UID] = true
+			}
+			if len(seen) != 20 {
+				t.Fatalf("streamed %d distinct rows, want 10 from each server", len(seen))
+			}
+
+			want := 10
+			if noStoreRun {
+				want = 0
+			}
+			for _, server := range []string{"www", "br"} {
+				if n := storedProfiles(t, server); n != want {
+					t.Errorf("%s stored %d profiles, want %d", server, n, want)
+				}
+			}
+		})
+	}
+}
+
+func TestMaxDurationShutsDownCleanly(t *testing.T) {
+	tests := []struct {
+		name     string
+		duration time.Duration
+		signal   time.Duration
+	}{
+		{"deadline", 150 * time.Millisecond, 0},
+		{"signal before deadline", 10 * time.Second, 150 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			srv, served := pageServer(t, 5*time.Millisecond)
+			setHost(t, "www", srv.URL)
+
+			// The same composition as main: a signal context wrapped in the
+			// -max-duration timeout.
+			ctx, interrupt := context.WithCancel(context.Background())
+			defer interrupt()
+			if tt.signal > 0 {
+				time.AfterFunc(tt.signal, interrupt)
+			}
+			ctx, cancel := context.WithTimeout(ctx, tt.duration)
+			defer cancel()
+
+			started := time.Now()
+			if err := run(ctx, "www", testClient()); err != nil {
+				t.Fatal(err)
+			}
+			if took := time.Since(started); took > time.Second {
+				t.Fatalf("run took %v to stop", took)
+			}
+
+			var last map[string]any
+			if err := loadJSON(filepath.Join("Data", "www", "last.json"), &last); err != nil {
+				t.Fatalf("last.json was not saved: %v", err)
+			}
+			next := int(last["page"].(float64))
+			if next <= 1 {
+				t.Fatalf("last.json page = %d, want progress past page 1", next)
+			}
+			if n := storedProfiles(t, "www"); n != next-1 || int64(n) != served.Load() {
+				t.Fatalf("stored %d profiles, served %d pages, last.json resumes at %d", n, served.Load(), next)
+			}
+			if _, err := os.Stat(filepath.Join("Data", "www", "lock")); !os.IsNotExist(err) {
+				t.Fatalf("run left its lock behind: %v", err)
+			}
+		})
+	}
+}
+
+func TestExportArchiveRoundTrip(t *testing.T) {
+	for _, compact := range []bool{false, true} {
+		t.Run(fmt.Sprintf("compact=%v", compact), func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			setFlag(t, compactJSON, compact)
+			bm := NewBucketManager(filepath.Join("Data", "www"), false)
+			bm.Update("1", map[string]any{"username": "alice", "rank": 1.0}, 1)
+			bm.Update("2", map[string]any{"username": "bob", "rank": 2.0}, 1)
+			bm.Update("3", map[string]any{"username": "carol", "rank": 20001.0}, 801)
+			if err := bm.SaveDirty(); err != nil {
+				t.Fatal(err)
+			}
+
+			dest := filepath.Join(t.TempDir(), "www.tar.gz")
+			m, err := exportArchive("www", dest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.Server != "www" || m.Buckets != 2 || m.Profiles != 3 || m.DataFile != *dataName {
+				t.Fatalf("manifest = %+v", m)
+			}
+
+			f, err := os.Open(dest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			zr, err := gzip.NewReader(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tr := tar.NewReader(zr)
+			var names []string
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				b, _ := io.ReadAll(tr)
+				names = append(names, hdr.Name)
+				if hdr.Name == ARCHIVE_MANIFEST {
+					var got ArchiveManifest
+					if err := json.Unmarshal(b, &got); err != nil || got != m {
+						t.Fatalf("archived manifest %+v (%v), want %+v", got, err, m)
+					}
+					continue
+				}
+				disk, err := os.ReadFile(filepath.Join("Data", "www", filepath.FromSlash(hdr.Name)))
+				if err != nil || !bytes.Equal(b, disk) {
+					t.Fatalf("%s differs from the bucket file on disk (%v)", hdr.Name, err)
+				}
+			}
+			want := []string{ARCHIVE_MANIFEST, "1to20000/" + *dataName, "20001to40000/" + *dataName}
+			if !slices.Equal(names, want) {
+				t.Fatalf("archive entries %v, want %v", names, want)
+			}
+		})
+	}
+}
+
+func TestWorkerGapSpacesEachWorker(t *testing.T) {
+	t.Chdir(t.TempDir())
+	srv, _ := pageServer(t, 0)
+	times := requestTimes(srv)
+	setHost(t, "www", srv.URL)
+	setFlag(t, maxPages, 4*WORKERS)
+
+	const gap = 60 * time.Millisecond
+	setFlag(t, workerGap, gap)
+	if err := run(context.Background(), "www", testClient()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Requests are not tagged with their worker, but any WORKERS+1
+	// consecutive ones include two from the same worker, so they must
+	// span at least one gap.
+	got := times()
+	if len(got) != 4*WORKERS {
+		t.Fatalf("served %d requests, want %d", len(got), 4*WORKERS)
+	}
+	for i := 0; i+WORKERS < len(got); i++ {
+		if span := got[i+WORKERS].Sub(got[i]); span < gap*9/10 {
+			t.Fatalf("requests %d to %d came within %v, want each worker at least %v apart", i+1, i+WORKERS+1, span, gap)
+		}
+	}
+}
+
+func TestWorkerGapHonoursCancel(t *testing.T) {
+	t.Chdir(t.TempDir())
+	srv, served := pageServer(t, 0)
+	setHost(t, "www", srv.URL)
+	setFlag(t, workerGap, time.Hour)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	started := time.Now()
+	if err := run(ctx, "www", testClient()); err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(started); took > time.Second {
+		t.Fatalf("run took %v to stop while workers waited out -worker-gap", took)
+	}
+	if n := served.Load(); n != WORKERS {
+		t.Fatalf("served %d pages, want one per worker before the gap", n)
+	}
+}
+
+func TestRetryStatusSet(t *testing.T) {
+	custom, err := parseStatusSet("429, 408, 5xx, !500")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		retryOn  func(int) bool
+		status   int
+		attempts int64
+	}{
+		{"default 500", nil, 500, 3},
+		{"default 503", nil, 503, 3},
+		{"default 429", nil, 429, 3},
+		{"default 408", nil, 408, 1},
+		{"default 404", nil, 404, 1},
+		{"custom 408", custom, 408, 3},
+		{"custom 429", custom, 429, 3},
+		{"custom 503", custom, 503, 3},
+		{"custom excludes 500", custom, 500, 1},
+		{"custom 404", custom, 404, 1},
+		{"custom 200", custom, 200, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts atomic.Int64
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				attempts.Add(1)
+				w.WriteHeader(tt.status)
+			}))
+			defer srv.Close()
+
+			client := testClient()
+			client.RetryOn = tt.retryOn
+			resp, err := client.Get(srv.URL)
+			if got := attempts.Load(); got != tt.attempts {
+				t.Fatalf("server saw %d attempts, want %d", got, tt.attempts)
+			}
+			if tt.attempts > 1 {
+				if err == nil {
+					t.Fatalf("Get returned status %d after exhausting its retries", resp.StatusCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Fatalf("Get returned status %d, want %d", resp.StatusCode, tt.status)
+			}
+		})
+	}
+
+	for _, spec := range []string{"abc", "99", "600", "6xx", "!", "4x"} {
+		if _, err := parseStatusSet(spec); err == nil {
+			t.Errorf("parseStatusSet(%q) accepted an invalid item", spec)
+		}
+	}
+}
+
+func TestProgressETA(t *testing.T) {
+	tests := []struct {
+		name       string
+		totalRanks int
+		step       int
+		page, done int
+		elapsed    time.Duration
+		want       string
+	}{
+		{"unknown total", 0, 1, 11, 10, time.Minute, "[www] page 11, 10.0 pages/min"},
+		{"known total", 50 * COUNT, 1, 11, 10, time.Minute, "[www] page 11, 10.0 pages/min, ~40 pages left, ETA 4m0s"},
+		{"partial last page", 50*COUNT - 1, 1, 41, 40, 2 * time.Minute, "[www] page 41, 20.0 pages/min, ~10 pages left, ETA 30s"},
+		{"stepped pages", 50 * COUNT, 5, 21, 4, time.Minute, "[www] page 21, 4.0 pages/min, ~6 pages left, ETA 1m30s"},
+		{"past the total", 10 * COUNT, 1, 15, 14, time.Minute, "[www] page 15, 14.0 pages/min, ~0 pages left, ETA 0s"},
+		{"stepped past the total", 11 * COUNT, 3, 13, 4, time.Minute, "[www] page 13, 4.0 pages/min, ~0 pages left, ETA 0s"},
+		{"nothing done yet", 50 * COUNT, 1, 1, 0, time.Second, "[www] page 1, 0.0 pages/min"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, totalRanks, tt.totalRanks)
+			setFlag(t, pageStep, tt.step)
+			endPage := 0
+			if *totalRanks > 0 {
+				endPage = pageForRank(*totalRanks)
+			}
+			if got := progressLine("www", tt.page, endPage, tt.done, tt.elapsed); got != tt.want {
+				t.Fatalf("progressLine = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFirstSaveComesEarly(t *testing.T) {
+	tests := []struct {
+		name      string
+		firstSave time.Duration
+		saved     bool
+	}{
+		{"grace period", 50 * time.Millisecond, true},
+		{"wait for the interval", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			srv, _ := pageServer(t, 5*time.Millisecond)
+			setHost(t, "www", srv.URL)
+			setFlag(t, firstSave, tt.firstSave)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error, 1)
+			go func() { done <- run(ctx, "www", testClient()) }()
+
+			// Look while the run is still going, long before SAVE_INTERVAL.
+			time.Sleep(200 * time.Millisecond)
+			_, statErr := os.Stat(filepath.Join("Data", "www", "last.json"))
+			stored := storedProfiles(t, "www")
+			cancel()
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+
+			if saved := statErr == nil && stored > 0; saved != tt.saved {
+				t.Fatalf("saved before the interval: %v (last.json: %v, %d profiles), want %v", saved, statErr, stored, tt.saved)
+			}
+		})
+	}
+}
+
+func TestCompactOutputRoundTrip(t *testing.T) {
+	data := map[string]any{
+		"1": map[string]any{
+			"latest":    map[string]any{"id": 1.0, "username": "alice", "rank": 1.0},
+			"pages":     []any{1.0, 3.0},
+			"last_seen": "2026-10-16T00:00:00Z",
+		},
+		"2": map[string]any{"latest": map[string]any{"id": 2.0, "username": "bob \"quoted\" <tag>"}},
+	}
+	var sizes [2]int
+	for i, compact := range []bool{false, true} {
+		t.Run(fmt.Sprintf("compact=%v", compact), func(t *testing.T) {
+			setFlag(t, compactJSON, compact)
+			path := filepath.Join(t.TempDir(), "data.json")
+			if err := atomicWrite(path, data); err != nil {
+				t.Fatal(err)
+			}
+			b, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sizes[i] = len(b)
+			if indented := bytes.Contains(b, []byte("\n  ")); indented == compact {
+				t.Errorf("indented output = %v with -compact=%v", indented, compact)
+			}
+
+			var back map[string]any
+			if err := loadJSON(path, &back); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(back, data) {
+				t.Fatalf("read back %v, want %v", back, data)
+			}
+		})
+	}
+	if sizes[1] >= sizes[0] {
+		t.Errorf("compact output is %d bytes, indented %d", sizes[1], sizes[0])
+	}
+}
+
+func TestRunReportAddsScrapeSection(t *testing.T) {
+	t.Chdir(t.TempDir())
+	srv, _ := pageServer(t, 0)
+	setHost(t, "www", srv.URL)
+	setFlag(t, maxPages, 4)
+	pagesIngested.Store(0)
+	rowsIngested.Store(0)
+
+	// A forensics section already in the report, as when the scan runs
+	// first, including a field this tool does not know about.
+	forensics := `{"profiles_scanned":10,"flagged":2,"by_category":{"INSULTS":2},"future_field":[1,2]}`
+	if err := os.WriteFile("report.json", []byte(`{"forensics":`+forensics+`}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	client := testClient()
+	started := time.Now()
+	if err := run(context.Background(), "www", client); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeRunReport("report.json", []string{"www"}, client, started); err != nil {
+		t.Fatal(err)
+	}
+
+	var report RunReport
+	if err := loadJSON("report.json", &report); err != nil {
+		t.Fatal(err)
+	}
+	s := report.Scrape
+	if s == nil || s.StartedAt == "" || !slices.Equal(s.Servers, []string{"www"}) || s.Pages != 4 || s.Rows != 4 || s.Requests != 4 || s.Failures != 0 {
+		t.Fatalf("scrape section %+v, want 4 pages, rows and requests from www", s)
+	}
+	var before, after any
+	json.Unmarshal([]byte(forensics), &before)
+	json.Unmarshal(report.Forensics, &after)
+	if !reflect.DeepEqual(before, after) {
+		t.Errorf("forensics section changed to %s", report.Forensics)
+	}
+}
+
+func TestDecodeRetries(t *testing.T) {
+	const valid = `{"data":[{"id":1,"username":"alice","rank":1}]}`
+	tests := []struct {
+		name     string
+		retries  int
+		bodies   []string
+		fetches  int
+		rows     int
+		errorHas string
+	}{
+		{"truncated then valid", 2, []string{`{"data":[{"id":1,"userna`, valid}, 2, 1, ""},
+		{"valid first", 2, []string{valid}, 1, 1, ""},
+		{"no retries", 0, []string{`{"data":[`, valid}, 1, 0, "did not decode after 1 fetches"},
+		{"stable malformed", 2, []string{`<html>oops</html>`, `<html>oops</html>`, `<html>oops</html>`}, 3, 0, "malformed response, identical on 3 fetches"},
+		{"different truncations", 2, []string{`{"da`, `{"data":[`, `{"data":[{"id"`}, 3, 0, "did not decode after 3 fetches"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fetches atomic.Int64
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := int(fetches.Add(1)) - 1
+				fmt.Fprint(w, tt.bodies[min(n, len(tt.bodies)-1)])
+			}))
+			defer srv.Close()
+			setHost(t, "www", srv.URL)
+			setFlag(t, decodeRetry, tt.retries)
+
+			rows, err := fetchPage(testClient(), nil, "www", 1)
+			if got := int(fetches.Load()); got != tt.fetches {
+				t.Errorf("fetched %d times, want %d", got, tt.fetches)
+			}
+			if tt.errorHas == "" {
+				if err != nil || len(rows) != tt.rows {
+					t.Fatalf("fetchPage = %d rows, %v; want %d rows", len(rows), err, tt.rows)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.errorHas) {
+				t.Fatalf("fetchPage error %v, want %q", err, tt.errorHas)
+			}
+		})
+	}
+}
+
+func TestStatusCountsPerServer(t *testing.T) {
+	t.Chdir(t.TempDir())
+	// mixServer refuses the first request for every third page with status
+	// and otherwise serves a one-row page, counting what it refused.
+	mixServer := func(status int) (*httptest.Server, *atomic.Int64) {
+		var refused atomic.Int64
+		var seen sync.Map
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			page := r.URL.Query().Get("page")
+			n, _ := strconv.Atoi(page)
+			if _, again := seen.LoadOrStore(page, true); !again && n%3 == 0 {
+				refused.Add(1)
+				w.WriteHeader(status)
+				return
+			}
+			fmt.Fprintf(w, `{"data":[{"id":%s,"username":"user%s","rank":%s}]}`, page, page, page)
+		}))
+		t.Cleanup(srv.Close)
+		return srv, &refused
+	}
+	www, www429 := mixServer(http.StatusTooManyRequests)
+	br, br503 := mixServer(http.StatusServiceUnavailable)
+	setHost(t, "www", www.URL)
+	setHost(t, "br", br.URL)
+	setFlag(t, maxPages, 20)
+
+	client := testClient()
+	for _, server := range []string{"www", "br"} {
+		if err := run(context.Background(), server, client); err != nil {
+			t.Fatal(err)
+		}
+		if n := storedProfiles(t, server); n != 20 {
+			t.Fatalf("%s stored %d profiles, want every page after its retries", server, n)
+		}
+	}
+
+	got := client.Statuses()
+	want := map[string]StatusCounts{
+		"www": {TooMany: www429.Load()},
+		"br":  {ServerError: br503.Load()},
+	}
+	if want["www"].TooMany == 0 || want["br"].ServerError == 0 {
+		t.Fatal("the servers refused nothing")
+	}
+	if !maps.Equal(got, want) {
+		t.Fatalf("status counts %+v, want %+v", got, want)
+	}
+	summary := client.Summary()
+	for _, part := range []string{
+		fmt.Sprintf("br: 429 x0, 5xx x%d", br503.Load()),
+		fmt.Sprintf("www: 429 x%d, 5xx x0", www429.Load()),
+	} {
+		if !strings.Contains(summary, part) {
+			t.Errorf("summary %q is missing %q", summary, part)
+		}
+	}
+}